@@ -0,0 +1,112 @@
+package fastcgi
+
+import (
+	"context"
+	"fast-php/fastcgi/fastcgitest"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//countDials counts connections dialed to the server.
+func countDials(srv *fastcgitest.Server, dialed *int32) Dialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		atomic.AddInt32(dialed, 1)
+
+		return srv.Dial(ctx)
+	}
+}
+
+//abortRequest sends request and cancels it once the backend started it.
+func abortRequest(t *testing.T, c *Client, srv *fastcgitest.Server) *AbortError {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := len(srv.Requests())
+
+	resp, err := c.Do(NewRequest(httptest.NewRequest("GET", "/", nil).WithContext(ctx)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for len(srv.Requests()) == started {
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+	}()
+
+	_ = resp.WriteTo(httptest.NewRecorder(), ioutil.Discard)
+
+	abortErr, ok := resp.Err().(*AbortError)
+	if !ok {
+		t.Fatalf("request failed with %v, expected abort", resp.Err())
+	}
+
+	if abortErr.Cause != context.Canceled {
+		t.Fatalf("abort cause %v", abortErr.Cause)
+	}
+
+	return abortErr
+}
+
+func TestAbortRequest(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{Status: 200, Delay: 5 * time.Second}
+	})
+	defer srv.Close()
+
+	var dialed int32
+	c := NewClient(countDials(srv, &dialed), PoolConfig{})
+	defer c.Close()
+
+	if abortErr := abortRequest(t, c, srv); !abortErr.Ended {
+		t.Fatalf("backend ended the request, abort reported %v", abortErr)
+	}
+
+	select {
+		case <-srv.Requests()[0].Aborted():
+		default:
+			t.Fatal("FCGI_ABORT_REQUEST has not been sent")
+	}
+
+	//request ended by the backend leaves the connection usable
+	abortRequest(t, c, srv)
+
+	if n := atomic.LoadInt32(&dialed); n != 1 {
+		t.Fatalf("%d connections dialed, expected the connection to be reused", n)
+	}
+}
+
+func TestAbortIgnored(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{Status: 200, Delay: 5 * time.Second, IgnoreAbort: true}
+	})
+	defer srv.Close()
+
+	var dialed int32
+	c := NewClient(countDials(srv, &dialed), PoolConfig{}, OptionAbortTimeout(50*time.Millisecond))
+	defer c.Close()
+
+	start := time.Now()
+	if abortErr := abortRequest(t, c, srv); abortErr.Ended {
+		t.Fatal("backend ignoring the abort reported as ended")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("abort took %v", elapsed)
+	}
+
+	//connection of the request which has not ended is dropped
+	abortRequest(t, c, srv)
+
+	if n := atomic.LoadInt32(&dialed); n != 2 {
+		t.Fatalf("%d connections dialed, expected the connection to be retired", n)
+	}
+}
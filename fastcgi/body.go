@@ -0,0 +1,206 @@
+package fastcgi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+//largest body kept in memory by default
+const defaultBodyMemory = 64 * 1024
+
+//ErrBodyTooLarge is returned by Do when buffered request body exceeds BodyBuffer.MaxSize.
+var ErrBodyTooLarge = errors.New("gofast: request body is too large")
+
+//BodyError is returned when the request body could not be read, e.g. client went away during
+//the upload.
+type BodyError struct {
+	Err error
+}
+
+func (e *BodyError) Error() string {
+	return "gofast: request body read error: " + e.Err.Error()
+}
+
+func (e *BodyError) Unwrap() error {
+	return e.Err
+}
+
+//bodyReader reports read errors of the request body as BodyError.
+type bodyReader struct {
+	r io.Reader
+}
+
+func (b bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &BodyError{Err: err}
+	}
+
+	return n, err
+}
+
+//BodyBuffer reads request body before the request is sent, so CONTENT_LENGTH is known even for
+//chunked requests and the backend is not kept waiting for slow clients.
+type BodyBuffer struct {
+	//Memory is the largest body kept in memory, larger bodies are written to a temporary file.
+	//Defaults to 64KB.
+	Memory int64
+
+	//Dir is the directory of the temporary files, system temporary directory when empty.
+	Dir string
+
+	//MaxSize limits the body, zero means no limit.
+	MaxSize int64
+}
+
+//Valid validates the configuration.
+func (b *BodyBuffer) Valid() error {
+	if b.Memory < 0 || b.MaxSize < 0 {
+		return fmt.Errorf("invalid body buffer limits: memory %d, max size %d", b.Memory, b.MaxSize)
+	}
+
+	if b.Dir != "" {
+		if fi, err := os.Stat(b.Dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("invalid body buffer directory %q", b.Dir)
+		}
+	}
+
+	return nil
+}
+
+//OptionBodyBuffer buffers request body in memory or on disk and sends its exact length as
+//CONTENT_LENGTH.
+func OptionBodyBuffer(b *BodyBuffer) OptionRequest {
+	return func(req *Request) {
+		req.BodyBuffer = b
+	}
+}
+
+func (b *BodyBuffer) memory() int64 {
+	if b.Memory == 0 {
+		return defaultBodyMemory
+	}
+
+	return b.Memory
+}
+
+//spooledBody is request body read ahead, temporary file is kept until remove is called even
+//though the body has been sent.
+type spooledBody struct {
+	size int64
+	mem  *bytes.Reader
+	file *os.File
+}
+
+//spool reads the body into memory, spilling over to temporary file once memory limit is reached.
+func (b *BodyBuffer) spool(r io.Reader) (*spooledBody, error) {
+	r = bodyReader{r}
+
+	limit := b.MaxSize
+	if limit > 0 {
+		//one byte more to tell bodies of exactly the limit from larger ones
+		r = io.LimitReader(r, limit+1)
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, b.memory()+1)
+	if err == io.EOF {
+		if limit > 0 && n > limit {
+			return nil, ErrBodyTooLarge
+		}
+
+		return &spooledBody{size: n, mem: bytes.NewReader(buf.Bytes())}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(b.Dir, "fast-php-body-")
+	if err != nil {
+		return nil, err
+	}
+
+	body := &spooledBody{file: f}
+
+	body.size, err = io.Copy(f, io.MultiReader(&buf, r))
+	if err == nil && limit > 0 && body.size > limit {
+		err = ErrBodyTooLarge
+	}
+
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		body.remove()
+		return nil, err
+	}
+
+	return body, nil
+}
+
+func (s *spooledBody) Read(p []byte) (int, error) {
+	if s.file != nil {
+		return s.file.Read(p)
+	}
+
+	return s.mem.Read(p)
+}
+
+//Close does nothing, body is released by remove once the request is complete.
+func (s *spooledBody) Close() error {
+	return nil
+}
+
+//rewind makes the body readable from the start again.
+func (s *spooledBody) rewind() error {
+	if s.file != nil {
+		_, err := s.file.Seek(0, io.SeekStart)
+		return err
+	}
+
+	_, err := s.mem.Seek(0, io.SeekStart)
+
+	return err
+}
+
+//remove deletes temporary file of the body.
+func (s *spooledBody) remove() {
+	if s == nil || s.file == nil {
+		return
+	}
+
+	_ = s.file.Close()
+	_ = os.Remove(s.file.Name())
+}
+
+//spool replaces stdin by the buffered body and sets its length.
+func (req *Request) spool() error {
+	body, err := req.BodyBuffer.spool(req.Stdin)
+	_ = req.Stdin.Close()
+
+	if err != nil {
+		return err
+	}
+
+	req.Stdin, req.body = body, body
+	req.SetParam("CONTENT_LENGTH", strconv.FormatInt(body.size, 10))
+
+	return nil
+}
+
+//resendable reports whether the request can be sent again, its body is buffered or there is none.
+func (req *Request) resendable() bool {
+	if req.Data != nil {
+		return false
+	}
+
+	return req.body != nil || req.Stdin == nil || req.Stdin == http.NoBody
+}
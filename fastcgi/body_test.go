@@ -0,0 +1,106 @@
+package fastcgi
+
+import (
+	"fast-php/fastcgi/fastcgitest"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyBufferSpool(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		size    int
+		maxSize int64
+		file    bool
+		err     error
+	}{
+		{size: 0},
+		{size: 10},
+		{size: 16},
+		{size: 17, file: true},
+		{size: 1000, file: true},
+		{size: 10, maxSize: 10},
+		{size: 11, maxSize: 10, err: ErrBodyTooLarge},
+		{size: 100, maxSize: 100, file: true},
+		{size: 101, maxSize: 100, err: ErrBodyTooLarge},
+	}
+
+	for _, test := range tests {
+		b := &BodyBuffer{Memory: 16, Dir: dir, MaxSize: test.maxSize}
+		input := strings.Repeat("b", test.size)
+
+		body, err := b.spool(strings.NewReader(input))
+		if err != test.err {
+			t.Fatalf("%d: error = %v, want %v", test.size, err, test.err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if body.size != int64(test.size) || (body.file != nil) != test.file {
+			t.Fatalf("%d: size %d, file %v", test.size, body.size, body.file != nil)
+		}
+
+		output, err := ioutil.ReadAll(body)
+		if err != nil || string(output) != input {
+			t.Fatalf("%d: read %d bytes, %v", test.size, len(output), err)
+		}
+
+		body.remove()
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d temporary files left", len(files))
+	}
+}
+
+func TestBodyBufferContentLength(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{Status: 200, Stdout: [][]byte{req.Stdin}}
+	})
+	defer srv.Close()
+
+	c := NewClient(srv.Dial, PoolConfig{})
+	defer c.Close()
+
+	dir := t.TempDir()
+	input := strings.Repeat("chunked ", 1000)
+
+	r := httptest.NewRequest("POST", "/upload.php", ioutil.NopCloser(strings.NewReader(input)))
+	r.ContentLength = -1
+
+	req := NewRequest(r, OptionBodyBuffer(&BodyBuffer{Memory: 1024, Dir: dir}))
+	if req.Param("CONTENT_LENGTH") != "" {
+		t.Fatalf("chunked request has CONTENT_LENGTH %q", req.Param("CONTENT_LENGTH"))
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := resp.WriteTo(w, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Body.String() != input {
+		t.Fatalf("backend received %d bytes", w.Body.Len())
+	}
+
+	if got := srv.Requests()[0].Params["CONTENT_LENGTH"]; got != "8000" {
+		t.Fatalf("CONTENT_LENGTH = %q", got)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d temporary files left", len(files))
+	}
+}
@@ -0,0 +1,293 @@
+package fastcgi
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//buckets of the sliding window of the breaker
+const breakerBuckets = 10
+
+//ErrCircuitOpen is returned when circuit breaker of the backend rejected the request.
+var ErrCircuitOpen = errors.New("gofast: circuit breaker is open")
+
+//BreakerState is state of the circuit breaker.
+type BreakerState int
+
+const (
+	//BreakerClosed passes requests to the backend and counts their outcome.
+	BreakerClosed BreakerState = iota
+
+	//BreakerOpen rejects requests until BreakerConfig.OpenTimeout passes.
+	BreakerOpen
+
+	//BreakerHalfOpen lets BreakerConfig.Probes requests through, breaker closes once all of them
+	//succeed and opens again on the first failure.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+		case BreakerOpen:
+			return "open"
+
+		case BreakerHalfOpen:
+			return "half-open"
+
+		default:
+			return "closed"
+	}
+}
+
+//BreakerConfig configures circuit breaker of every backend of the upstream. Breaker trips when
+//share of failed or slow requests within the sliding window reaches the threshold, backend is
+//unavailable while it is open so requests are passed to the other backends.
+type BreakerConfig struct {
+	//Window is the sliding window the outcome of requests is counted in, defaults to 10 seconds.
+	Window time.Duration
+
+	//MinRequests within the window before the breaker can trip, defaults to 20.
+	MinRequests int
+
+	//ErrorRate of failed requests tripping the breaker, from 0 to 1. Defaults to 0.5.
+	ErrorRate float64
+
+	//Latency makes requests whose first output took longer than given time count as slow,
+	//disabled when zero. Requests without output are measured until they end.
+	Latency time.Duration
+
+	//SlowRate of slow requests tripping the breaker, from 0 to 1. Defaults to 0.5.
+	SlowRate float64
+
+	//OpenTimeout the breaker stays open for before the probes are let through, defaults to
+	//10 seconds.
+	OpenTimeout time.Duration
+
+	//Probes let through when half-open, defaults to 1.
+	Probes int
+}
+
+//InitDefaults sets missing values to their default values.
+func (cfg *BreakerConfig) InitDefaults() error {
+	if cfg.Window == 0 {
+		cfg.Window = 10 * time.Second
+	}
+
+	if cfg.MinRequests == 0 {
+		cfg.MinRequests = 20
+	}
+
+	if cfg.ErrorRate == 0 {
+		cfg.ErrorRate = 0.5
+	}
+
+	if cfg.SlowRate == 0 {
+		cfg.SlowRate = 0.5
+	}
+
+	if cfg.OpenTimeout == 0 {
+		cfg.OpenTimeout = 10 * time.Second
+	}
+
+	if cfg.Probes == 0 {
+		cfg.Probes = 1
+	}
+
+	return nil
+}
+
+//Valid validates the configuration, zero values are valid as they stand for the defaults set by
+//InitDefaults.
+func (cfg *BreakerConfig) Valid() error {
+	if cfg.Window < 0 || cfg.OpenTimeout < 0 || cfg.Latency < 0 || cfg.MinRequests < 0 || cfg.Probes < 0 {
+		return errors.New("gofast: invalid breaker limits")
+	}
+
+	if cfg.ErrorRate < 0 || cfg.ErrorRate > 1 || cfg.SlowRate < 0 || cfg.SlowRate > 1 {
+		return errors.New("gofast: breaker rates must be within [0, 1]")
+	}
+
+	return nil
+}
+
+//bucket counts requests completed within its part of the window.
+type bucket struct {
+	start  time.Time
+	total  int
+	failed int
+	slow   int
+}
+
+//breaker is circuit breaker of single backend.
+type breaker struct {
+	cfg *BreakerConfig
+
+	//called with the new state, outside of the lock
+	changed func(state BreakerState)
+
+	mu      sync.Mutex
+	state   BreakerState
+	opened  time.Time
+	buckets [breakerBuckets]bucket
+
+	//probes in flight and succeeded while half-open
+	probing int
+	passed  int
+
+	//times the breaker opened
+	trips uint64
+}
+
+func newBreaker(cfg *BreakerConfig, changed func(state BreakerState)) *breaker {
+	return &breaker{cfg: cfg, changed: changed}
+}
+
+//ready reports whether breaker would let the request through, nothing is reserved.
+func (br *breaker) ready() bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	switch br.state {
+		case BreakerOpen:
+			return time.Since(br.opened) >= br.cfg.OpenTimeout
+
+		case BreakerHalfOpen:
+			return br.probing < br.cfg.Probes-br.passed
+
+		default:
+			return true
+	}
+}
+
+//acquire lets the request through, open breaker turns half-open once the open timeout passed.
+//Request let through must be reported by done along with the probe flag.
+func (br *breaker) acquire() (ok bool, probe bool) {
+	br.mu.Lock()
+
+	switch br.state {
+		case BreakerOpen:
+			if time.Since(br.opened) < br.cfg.OpenTimeout {
+				br.mu.Unlock()
+				return false, false
+			}
+
+			br.state, br.probing, br.passed = BreakerHalfOpen, 1, 0
+			br.mu.Unlock()
+
+			br.changed(BreakerHalfOpen)
+
+			return true, true
+
+		case BreakerHalfOpen:
+			if br.probing >= br.cfg.Probes-br.passed {
+				br.mu.Unlock()
+				return false, false
+			}
+
+			br.probing++
+			br.mu.Unlock()
+
+			return true, true
+	}
+
+	br.mu.Unlock()
+
+	return true, false
+}
+
+//done records outcome of the request let through, requests which tell nothing about the backend,
+//e.g. aborted by the client, are only released. Outcome of the requests which started in other
+//state than the current one is ignored.
+func (br *breaker) done(probe, counted, failed bool, elapsed time.Duration) {
+	slow := br.cfg.Latency > 0 && elapsed > br.cfg.Latency
+
+	br.mu.Lock()
+
+	changed := false
+	switch {
+		case probe && br.state == BreakerHalfOpen:
+			br.probing--
+			if !counted {
+				break
+			}
+
+			if failed || slow {
+				br.open()
+				changed = true
+			} else if br.passed++; br.passed >= br.cfg.Probes {
+				br.close()
+				changed = true
+			}
+
+		case !probe && br.state == BreakerClosed:
+			if counted && br.count(failed, slow) {
+				br.open()
+				changed = true
+			}
+	}
+
+	state := br.state
+	br.mu.Unlock()
+
+	if changed {
+		br.changed(state)
+	}
+}
+
+//count adds the outcome to the window and reports whether the breaker should trip.
+func (br *breaker) count(failed, slow bool) bool {
+	now := time.Now()
+	width := br.cfg.Window / breakerBuckets
+	if width <= 0 {
+		width = 1
+	}
+
+	b := &br.buckets[now.UnixNano()/int64(width)%breakerBuckets]
+	if start := now.Truncate(width); !b.start.Equal(start) {
+		*b = bucket{start: start}
+	}
+
+	b.total++
+	if failed {
+		b.failed++
+	}
+
+	if slow {
+		b.slow++
+	}
+
+	var total, failures, slows int
+	for _, b := range br.buckets {
+		if now.Sub(b.start) < br.cfg.Window {
+			total, failures, slows = total+b.total, failures+b.failed, slows+b.slow
+		}
+	}
+
+	if total < br.cfg.MinRequests {
+		return false
+	}
+
+	return float64(failures) >= br.cfg.ErrorRate*float64(total) ||
+		br.cfg.Latency > 0 && float64(slows) >= br.cfg.SlowRate*float64(total)
+}
+
+//open trips the breaker, lock must be held.
+func (br *breaker) open() {
+	br.state, br.opened, br.probing = BreakerOpen, time.Now(), 0
+	br.trips++
+}
+
+//close closes the breaker and starts new window, lock must be held.
+func (br *breaker) close() {
+	br.state, br.probing, br.passed = BreakerClosed, 0, 0
+	br.buckets = [breakerBuckets]bucket{}
+}
+
+//stats returns current state and number of trips.
+func (br *breaker) stats() (BreakerState, uint64) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	return br.state, br.trips
+}
@@ -0,0 +1,103 @@
+package fastcgi
+
+import (
+	"testing"
+	"time"
+)
+
+func testBreaker(cfg *BreakerConfig) (*breaker, *[]BreakerState) {
+	_ = cfg.InitDefaults()
+
+	var states []BreakerState
+	return newBreaker(cfg, func(state BreakerState) {
+		states = append(states, state)
+	}), &states
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	br, states := testBreaker(&BreakerConfig{MinRequests: 4, ErrorRate: 0.5, OpenTimeout: 50 * time.Millisecond, Probes: 2})
+
+	for _, failed := range []bool{false, true, false} {
+		if ok, probe := br.acquire(); !ok || probe {
+			t.Fatal("closed breaker rejected request")
+		}
+
+		br.done(false, true, failed, 0)
+	}
+
+	//requests aborted by the client are not counted
+	br.done(false, false, true, 0)
+
+	if state, _ := br.stats(); state != BreakerClosed {
+		t.Fatalf("breaker %s before min requests", state)
+	}
+
+	br.done(false, true, true, 0)
+	if state, trips := br.stats(); state != BreakerOpen || trips != 1 {
+		t.Fatalf("breaker %s after %d trips", state, trips)
+	}
+
+	if ok, _ := br.acquire(); ok || br.ready() {
+		t.Fatal("open breaker let request through")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if !br.ready() {
+		t.Fatal("breaker is not ready after open timeout")
+	}
+
+	for i := 0; i < 2; i++ {
+		if ok, probe := br.acquire(); !ok || !probe {
+			t.Fatalf("probe %d rejected", i)
+		}
+	}
+
+	if ok, _ := br.acquire(); ok {
+		t.Fatal("half-open breaker let more than 2 probes through")
+	}
+
+	//outcome of the request started while closed is ignored
+	br.done(false, true, true, 0)
+
+	br.done(true, true, false, 0)
+	br.done(true, true, false, 0)
+
+	if state, _ := br.stats(); state != BreakerClosed {
+		t.Fatalf("breaker %s after passed probes", state)
+	}
+
+	want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(*states) != len(want) {
+		t.Fatalf("states = %v", *states)
+	}
+
+	for i, s := range want {
+		if (*states)[i] != s {
+			t.Fatalf("states = %v", *states)
+		}
+	}
+}
+
+func TestBreakerLatency(t *testing.T) {
+	br, _ := testBreaker(&BreakerConfig{MinRequests: 2, Latency: 10 * time.Millisecond, OpenTimeout: time.Millisecond})
+
+	br.done(false, true, false, time.Millisecond)
+	br.done(false, true, false, 20*time.Millisecond)
+
+	if state, _ := br.stats(); state != BreakerOpen {
+		t.Fatalf("breaker %s after slow requests", state)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	//slow probe opens the breaker again
+	if ok, probe := br.acquire(); !ok || !probe {
+		t.Fatal("probe rejected")
+	}
+
+	br.done(true, true, false, 20*time.Millisecond)
+	if state, trips := br.stats(); state != BreakerOpen || trips != 2 {
+		t.Fatalf("breaker %s after %d trips", state, trips)
+	}
+}
@@ -0,0 +1,258 @@
+package fastcgi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+)
+
+//headerAccelBuffering set to "no" by the application makes the response streamed, as with nginx.
+const headerAccelBuffering = "X-Accel-Buffering"
+
+//ResponseMode controls how response of the backend is passed to the client.
+type ResponseMode int
+
+const (
+	//ResponsePiped passes response as it is read, flushing is left to the http server unless
+	//application sends X-Accel-Buffering: no.
+	ResponsePiped ResponseMode = iota
+
+	//ResponseStreaming flushes the output after every FCGI_STDOUT record, e.g. for Server-Sent
+	//Events.
+	ResponseStreaming
+
+	//ResponseBuffered reads complete response into memory or temporary file before it is passed
+	//to the client, so the backend is not held by slow clients. Application can still stream the
+	//response by sending X-Accel-Buffering: no.
+	ResponseBuffered
+)
+
+//OptionStreaming flushes the response after every FCGI_STDOUT record.
+func OptionStreaming() OptionRequest {
+	return func(req *Request) {
+		req.Mode = ResponseStreaming
+	}
+}
+
+//OptionBuffered reads complete response before it is passed to the client, Memory and Dir of the
+//buffer are used, MaxSize only applies to the request bodies.
+func OptionBuffered(b *BodyBuffer) OptionRequest {
+	return func(req *Request) {
+		req.Mode = ResponseBuffered
+		req.ResponseBuffer = b
+	}
+}
+
+//responseBuffer keeps stdout of buffered response until the request is complete. Header block is
+//inspected as it arrives, buffer turns into pipe once application disables the buffering.
+type responseBuffer struct {
+	cfg *BodyBuffer
+
+	//header block read so far, up to limit bytes
+	head   []byte
+	limit  int
+	headed bool
+
+	mu     sync.Mutex
+	mem    bytes.Buffer
+	file   *os.File
+	pw     *io.PipeWriter
+	closed bool
+
+	//closed once the response is complete or streamed, r is set before
+	ready chan struct{}
+	r     io.Reader
+}
+
+func newResponseBuffer(cfg *BodyBuffer, limits HeaderLimits) *responseBuffer {
+	if cfg == nil {
+		cfg = &BodyBuffer{}
+	}
+
+	return &responseBuffer{
+		cfg:   cfg,
+		limit: limits.maxSize(),
+		ready: make(chan struct{}),
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+
+	//pipe must not be written under the lock, Close would wait for the client otherwise
+	if pw := b.pw; pw != nil {
+		b.mu.Unlock()
+		return pw.Write(p)
+	}
+
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if err := b.store(p); err != nil {
+		return 0, err
+	}
+
+	if !b.headed {
+		b.inspect(p)
+	}
+
+	return len(p), nil
+}
+
+//store appends the output, memory is spilled over to temporary file once its limit is reached.
+func (b *responseBuffer) store(p []byte) error {
+	if b.file == nil && int64(b.mem.Len()+len(p)) <= b.cfg.memory() {
+		b.mem.Write(p)
+		return nil
+	}
+
+	if b.file == nil {
+		f, err := ioutil.TempFile(b.cfg.Dir, "fast-php-response-")
+		if err != nil {
+			return err
+		}
+
+		b.file = f
+		if _, err := b.mem.WriteTo(f); err != nil {
+			return err
+		}
+	}
+
+	_, err := b.file.Write(p)
+
+	return err
+}
+
+//inspect collects the header block, response is streamed from now on when it disables buffering.
+func (b *responseBuffer) inspect(p []byte) {
+	b.head = append(b.head, p...)
+
+	end := headerEnd(b.head)
+	if end == -1 {
+		if len(b.head) > b.limit {
+			b.headed, b.head = true, nil
+		}
+
+		return
+	}
+
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(b.head[:end])))
+	header, _ := r.ReadMIMEHeader()
+	b.headed, b.head = true, nil
+
+	if strings.EqualFold(header.Get(headerAccelBuffering), "no") {
+		pr, pw := io.Pipe()
+		b.pw, b.r = pw, io.MultiReader(b.stored(), pr)
+		close(b.ready)
+	}
+}
+
+//headerEnd returns length of the header block including the blank line, -1 when incomplete.
+func headerEnd(b []byte) int {
+	for i := 0; i < len(b); i++ {
+		if b[i] != '\n' {
+			continue
+		}
+
+		rest := b[i+1:]
+		switch {
+			case bytes.HasPrefix(rest, []byte("\n")):
+				return i + 2
+
+			case bytes.HasPrefix(rest, []byte("\r\n")):
+				return i + 3
+		}
+	}
+
+	return -1
+}
+
+//stored returns reader of the output stored so far.
+func (b *responseBuffer) stored() io.Reader {
+	if b.file == nil {
+		return &b.mem
+	}
+
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return errReader{err}
+	}
+
+	return b.file
+}
+
+func (b *responseBuffer) Read(p []byte) (int, error) {
+	<-b.ready
+
+	return b.r.Read(p)
+}
+
+func (b *responseBuffer) Close() error {
+	return b.CloseWithError(nil)
+}
+
+//CloseWithError completes the response, reader fails with the error once stored output is read.
+func (b *responseBuffer) CloseWithError(err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+
+	b.closed = true
+
+	if b.pw != nil {
+		return b.pw.CloseWithError(err)
+	}
+
+	b.r = b.stored()
+	if err != nil {
+		b.r = io.MultiReader(b.r, errReader{err})
+	}
+
+	close(b.ready)
+
+	return nil
+}
+
+//remove deletes temporary file of the response.
+func (b *responseBuffer) remove() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.file != nil {
+		_ = b.file.Close()
+		_ = os.Remove(b.file.Name())
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+//flushWriter flushes every write, it must not implement io.ReaderFrom so the writes are not
+//merged by io.Copy.
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.f.Flush()
+
+	return n, err
+}
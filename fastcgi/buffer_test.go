@@ -0,0 +1,154 @@
+package fastcgi
+
+import (
+	"bytes"
+	"fast-php/fastcgi/fastcgitest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//flushRecorder counts flushes of the response.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushes++
+	r.ResponseRecorder.Flush()
+}
+
+func chunkedServer(t *testing.T, header http.Header) *fastcgitest.Server {
+	srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{
+			Status:     200,
+			Header:     header,
+			Stdout:     [][]byte{[]byte("one "), bytes.Repeat([]byte("x"), 100), []byte(" three")},
+			ChunkDelay: 20 * time.Millisecond,
+		}
+	})
+
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+//complete reports whether the request completes before the response is read.
+func complete(resp *ResponsePipe) bool {
+	select {
+		case <-resp.done:
+			return true
+
+		case <-time.After(time.Second):
+			return false
+	}
+}
+
+func TestBufferedResponse(t *testing.T) {
+	srv := chunkedServer(t, http.Header{"Content-Type": {"text/plain"}})
+	c := NewClient(srv.Dial, PoolConfig{})
+	dir := t.TempDir()
+
+	req := NewRequest(httptest.NewRequest("GET", "/page.php", nil), OptionBuffered(&BodyBuffer{Memory: 16, Dir: dir}))
+
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !complete(resp) {
+		t.Fatal("backend is held until the response is read")
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("response spilled into %d files", len(files))
+	}
+
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	if err := resp.WriteTo(w, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "one " + strings.Repeat("x", 100) + " three"; w.Body.String() != want {
+		t.Fatalf("body = %q", w.Body.String())
+	}
+
+	if w.flushes != 0 {
+		t.Fatalf("buffered response flushed %d times", w.flushes)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d temporary files left", len(files))
+	}
+}
+
+func TestBufferedResponseDisabledByApplication(t *testing.T) {
+	srv := chunkedServer(t, http.Header{"Content-Type": {"text/event-stream"}, "X-Accel-Buffering": {"no"}})
+	c := NewClient(srv.Dial, PoolConfig{})
+
+	req := NewRequest(httptest.NewRequest("GET", "/events.php", nil), OptionBuffered(&BodyBuffer{}))
+
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	if err := resp.WriteTo(w, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.flushes < 3 {
+		t.Fatalf("response flushed %d times", w.flushes)
+	}
+
+	if w.Header().Get("X-Accel-Buffering") != "" {
+		t.Fatal("X-Accel-Buffering passed to the client")
+	}
+
+	if !strings.HasPrefix(w.Body.String(), "one ") || !strings.HasSuffix(w.Body.String(), " three") {
+		t.Fatalf("body = %q", w.Body.String())
+	}
+}
+
+func TestStreamingResponse(t *testing.T) {
+	srv := chunkedServer(t, http.Header{"Content-Type": {"text/event-stream"}})
+	c := NewClient(srv.Dial, PoolConfig{})
+
+	resp, err := c.Do(NewRequest(httptest.NewRequest("GET", "/events.php", nil), OptionStreaming()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	if err := resp.WriteTo(w, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	//headers and every record
+	if w.flushes < 4 {
+		t.Fatalf("response flushed %d times", w.flushes)
+	}
+}
+
+func TestHeaderEnd(t *testing.T) {
+	tests := []struct {
+		head string
+		end  int
+	}{
+		{"Status: 200\r\n\r\nbody", 15},
+		{"A: 1\n\nbody", 6},
+		{"A: 1\r\nB: 2\r\n", -1},
+		{"A: 1\r\n", -1},
+	}
+
+	for _, test := range tests {
+		if end := headerEnd([]byte(test.head)); end != test.end {
+			t.Errorf("headerEnd(%q) = %d, want %d", test.head, end, test.end)
+		}
+	}
+}
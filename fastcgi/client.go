@@ -2,127 +2,252 @@ package fastcgi
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
-type client struct {
-	conn *conn
-	ids  idPool
+//default time aborted request is given to end before its connection is dropped
+const defaultAbortTimeout = 5 * time.Second
+
+//Client executes FastCGI requests over pooled connections to a single backend.
+type Client struct {
+	pool *pool
+
+	//backend name reported with the responses
+	name string
+
+	//how long to wait for FCGI_END_REQUEST of the aborted request
+	abortTimeout time.Duration
+
+	timeouts Timeouts
+	limits   HeaderLimits
+
+	//traces requests which have no tracer of their own
+	trace *Tracer
+}
+
+//OptionClient configures the client.
+type OptionClient func(c *Client)
+
+//NewClient creates new client which opens backend connections using given dialer.
+func NewClient(dialer Dialer, cfg PoolConfig, opts ...OptionClient) *Client {
+	c := &Client{
+		abortTimeout: defaultAbortTimeout,
+	}
+
+	for _, fn := range opts {
+		fn(c)
+	}
+
+	c.pool = newPool(c.timeouts.dialer(dialer), cfg)
+
+	return c
+}
+
+//OptionAbortTimeout sets how long backend is given to end the aborted request, connection is
+//dropped when it does not. Defaults to 5 seconds.
+func OptionAbortTimeout(d time.Duration) OptionClient {
+	return func(c *Client) {
+		c.abortTimeout = d
+	}
+}
+
+//OptionName names the backend of the client, e.g. by its address. Name is reported by the
+//responses so the output can be traced to the backend.
+func OptionName(name string) OptionClient {
+	return func(c *Client) {
+		c.name = name
+	}
 }
 
-func (c *client) writeRequest(reqID uint16, req *Request) (err error) {
+//OptionHeaderLimits limits size of the response headers, see HeaderLimits.
+func OptionHeaderLimits(limits HeaderLimits) OptionClient {
+	return func(c *Client) {
+		c.limits = limits
+	}
+}
+
+//OptionTimeouts limits phases of the requests, see Timeouts.
+func OptionTimeouts(t Timeouts) OptionClient {
+	return func(c *Client) {
+		c.timeouts = t
+	}
+}
+
+func (c *Client) writeRequest(cn *conn, reqID uint16, req *Request, keepConn uint8) (err error) {
 	defer func() {
 		if err != nil {
 			//end request
-			_ = c.conn.writeAbortRequest(reqID)
+			_ = cn.writeAbortRequest(reqID)
 		}
 	}()
 
-	if err = c.conn.writeBeginRequest(reqID, req.Role, req.KeepConn); err != nil {
+	if err = cn.writeBeginRequest(reqID, req.Role, keepConn); err != nil {
 		return
 	}
 
-	if err = c.conn.writePairs(typeParams, reqID, req.Params); err != nil {
+	if err = cn.writePairs(typeParams, reqID, req.Pairs()); err != nil {
 		return
 	}
 
-	stdinWriter := newWriter(c.conn, typeStdin, reqID)
-	if req.Stdin != nil {
+	if err = c.writeStream(cn, typeStdin, reqID, req.Stdin); err != nil {
+		return
+	}
+
+	//filter applications receive the file after stdin
+	if req.Role == RoleFilter {
+		if err = c.writeStream(cn, typeData, reqID, req.Data); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+//writeStream copies reader into the stream of given type and closes both.
+func (c *Client) writeStream(cn *conn, recType recType, reqID uint16, r io.ReadCloser) (err error) {
+	streamWriter := newWriter(cn, recType, reqID)
+	if r != nil {
 		defer func() {
-			_ = req.Stdin.Close()
+			_ = r.Close()
 		}()
 
 		p := make([]byte, 1024)
 		var count int
 
 		for {
-			count, err = req.Stdin.Read(p)
+			count, err = r.Read(p)
 
 			if err == io.EOF {
 				err = nil
 			} else if err != nil {
-				_ = stdinWriter.Close()
-				return
+				_ = streamWriter.Close()
+				return &BodyError{Err: err}
 			}
 
 			if count == 0 {
 				break
 			}
 
-			_, err = stdinWriter.Write(p[:count])
+			_, err = streamWriter.Write(p[:count])
 
 			if err != nil {
-				_ = stdinWriter.Close()
+				_ = streamWriter.Close()
 				return
 			}
 		}
 	}
 
-	if err = stdinWriter.Close(); err != nil {
+	if err = streamWriter.Close(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (c *client) readResponse(ctx context.Context, resp *ResponsePipe, req *Request) (err error) {
-	var rec serviceRecord
-	done := make(chan int)
-
-	go func() {
-		readLoop:
+//send writes the request, socket deadlines are only applied to connections which are not shared
+//with other requests.
+func (c *Client) send(pc *poolConn, reqID uint16, req *Request, keepConn uint8) error {
+	if pc.mux != nil {
+		return c.writeRequest(pc.conn, reqID, req, keepConn)
+	}
 
-		for {
-			if err := rec.read(c.conn.rwc); err != nil {
-				break
-			}
+	if c.timeouts.Send > 0 {
+		_ = pc.netConn.SetWriteDeadline(time.Now().Add(c.timeouts.Send))
+		defer pc.netConn.SetWriteDeadline(time.Time{})
+	}
 
-			switch rec.h.Type {
-				case typeStdout:
-					resp.stdOutWriter.Write(rec.body())
+	err := c.writeRequest(pc.conn, reqID, req, keepConn)
+	if isTimeout(err) {
+		return ErrSendTimeout
+	}
 
-				case typeStderr:
-					resp.stdErrWriter.Write(rec.body())
+	return err
+}
 
-				case typeEndRequest:
-					break readLoop
+func (c *Client) readResponse(ctx context.Context, pc *poolConn, reqID uint16, s *stream, total time.Time) (err error) {
+	//multiplexed connections are read by the demux
+	if pc.mux == nil {
+		go s.read(pc.conn, pc.netConn, reqID, c.timeouts.ReadIdle)
+	}
 
-				default:
-					err := fmt.Sprintf("unexpected type %#v in readLoop", rec.h.Type)
-					resp.stdErrWriter.Write([]byte(err))
-			}
-		}
+	var expired <-chan time.Time
+	if !total.IsZero() {
+		timer := time.NewTimer(time.Until(total))
+		defer timer.Stop()
 
-		close(done)
-	}()
+		expired = timer.C
+	}
 
 	select {
 		case <-ctx.Done():
-			err = fmt.Errorf("gofast: timeout or canceled")
-		case <-done:
-			//do nothing and end the function
+			err = c.abort(ctx.Err(), pc, reqID, s)
+
+		case <-expired:
+			s.resp.closeWithError(ErrTotalTimeout)
+			_ = c.abort(ErrTotalTimeout, pc, reqID, s)
+			err = ErrTotalTimeout
+
+		case <-s.ended:
+			err = s.err
 	}
 
 	return
 }
 
-func (c *client) Do(req *Request) (resp *ResponsePipe, err error) {
-	if c.conn == nil {
-		err = fmt.Errorf("client connection has been closed")
+//get takes connection from the pool, wait for the connection counts toward the total timeout.
+func (c *Client) get(ctx context.Context, total time.Time) (*poolConn, error) {
+	if total.IsZero() {
+		return c.pool.get(ctx)
+	}
+
+	tctx, cancel := context.WithDeadline(ctx, total)
+	defer cancel()
 
-		return nil, err
+	pc, err := c.pool.get(tctx)
+	if err != nil && tctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, ErrTotalTimeout
 	}
 
-	reqID := c.ids.Alloc()
-	resp = NewResponsePipe()
-	rwError, allDone := make(chan error), make(chan int)
+	return pc, err
+}
+
+//abort asks backend to stop the request and waits a bounded time for it to end. Response pipes
+//are closed right away as nobody is going to read the rest of the response.
+func (c *Client) abort(cause error, pc *poolConn, reqID uint16, s *stream) *AbortError {
+	abortErr := &AbortError{Cause: cause}
+	s.resp.Close()
 
+	if err := pc.writeAbortRequest(reqID); err == nil {
+		timer := time.NewTimer(c.abortTimeout)
+		defer timer.Stop()
+
+		select {
+			case <-s.ended:
+				abortErr.Ended = s.err == nil
+			case <-timer.C:
+		}
+	}
+
+	//unblock the request writer, connection shared with other requests is closed once they are done
+	if !abortErr.Ended && pc.mux == nil {
+		_ = pc.netConn.Close()
+	}
+
+	return abortErr
+}
+
+//Do sends request to the backend using pooled connection. Response is streamed into returned
+//pipe, connection is given back to the pool once request is complete.
+func (c *Client) Do(req *Request) (resp *ResponsePipe, err error) {
 	//if there is a raw request, use the context deadline
 	var ctx context.Context
 	if req.Raw != nil {
@@ -131,72 +256,213 @@ func (c *client) Do(req *Request) (resp *ResponsePipe, err error) {
 		ctx = context.TODO()
 	}
 
+	//body is read before any connection is taken from the pool, body spooled by the caller
+	//already is sent again from the start and left to the caller to remove
+	owned := false
+	if req.body != nil {
+		if err = req.body.rewind(); err != nil {
+			return nil, err
+		}
+	} else if req.BodyBuffer != nil && req.Stdin != nil {
+		if err = req.spool(); err != nil {
+			return nil, err
+		}
+
+		owned = true
+		defer func() {
+			if err != nil {
+				req.body.remove()
+			}
+		}()
+	}
+
+	var total time.Time
+	if c.timeouts.Total > 0 {
+		total = time.Now().Add(c.timeouts.Total)
+	}
+
+	deadline := c.timeouts.deadline(ctx)
+
+	pc, err := c.get(ctx, total)
+	if err != nil {
+		return nil, err
+	}
+
+	reqID := pc.ids.Alloc()
+	resp = NewResponsePipe()
+	resp.backend = c.name
+	resp.sendfile, resp.raw = req.Sendfile, req.Raw
+	resp.localRedirects = req.LocalRedirects
+	resp.limits = c.limits
+	resp.mode = req.Mode
+
+	if req.Mode == ResponseBuffered {
+		resp.buffer = newResponseBuffer(req.ResponseBuffer, c.limits)
+		resp.stdOutReader, resp.stdOutWriter = resp.buffer, resp.buffer
+	}
+	s := newStream(resp)
+
+	trace := req.Trace
+	if trace == nil {
+		trace = c.trace
+	}
+
+	if trace != nil {
+		pc.trace(reqID, trace)
+	}
+
+	//backend would close the connection shared with other requests otherwise
+	keepConn := req.KeepConn
+	if pc.mux != nil {
+		keepConn = 1
+
+		if err = pc.mux.register(reqID, s); err != nil {
+			pc.trace(reqID, nil)
+			pc.ids.Release(reqID)
+			c.pool.put(pc, false)
+
+			return nil, err
+		}
+	}
+
+	//first byte deadline is set before the request is written so the reader can not miss it, the
+	//reader replaces it once the first record arrives
+	if pc.mux == nil && c.timeouts.FirstByte > 0 {
+		_ = pc.netConn.SetReadDeadline(time.Now().Add(c.timeouts.FirstByte))
+	}
+
+	//time spent waiting for the connection is not left to the application
+	if !deadline.IsZero() {
+		req.SetParam(deadlineParam, formatRemaining(deadline))
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	var writeErr, readErr error
 	go func() {
-		wg.Wait()
-		close(allDone)
-	}()
-
-	go func() {
-		if err := c.writeRequest(reqID, req); err != nil {
-			rwError <- err
+		//reader of the stalled exclusive connection would wait for the response forever
+		if writeErr = c.send(pc, reqID, req, keepConn); writeErr == ErrSendTimeout && pc.mux == nil {
+			_ = pc.netConn.Close()
 		}
 
 		wg.Done()
 	}()
 
 	go func() {
-		if err := c.readResponse(ctx, resp, req); err != nil {
-			rwError <- err
-		}
-
+		readErr = c.readResponse(ctx, pc, reqID, s, total)
 		wg.Done()
 	}()
 
+	//client failures are reported by Err, stderr only carries output of the application
 	go func() {
-		loop:
-			for {
-				select {
-					case err := <-rwError:
-						resp.stdErrWriter.Write([]byte(err.Error()))
-						continue
-					case <-allDone:
-						break loop
-				}
-			}
+		wg.Wait()
+
+		//send timeout is the cause of the failed read
+		failure := readErr
+		if failure == nil || writeErr == ErrSendTimeout {
+			failure = writeErr
+		}
+
+		//stream has ended when reader succeeded
+		if failure == nil {
+			failure = s.unexpected
+		}
+
+		//timeouts are reported to the response reader so the right status is sent, incomplete
+		//buffered response must not be passed as complete
+		if _, ok := failure.(*TimeoutError); ok || failure != nil && resp.buffer != nil {
+			resp.closeWithError(failure)
+		}
+
+		resp.Close()
+
+		//connection state is unknown unless response has been read completely, request ID of
+		//the stream which has not ended stays reserved until the connection is closed
+		reuse := keepConn == 1 && writeErr == nil
+		select {
+			case <-s.ended:
+				//stalled request has been ended by the backend, its connection is fine
+				reuse = reuse && (s.err == nil || s.err == ErrStreamStalled)
+				pc.trace(reqID, nil)
+				pc.ids.Release(reqID)
+			default:
+				reuse = false
+		}
 
-			c.ids.Release(reqID)
-			resp.Close()
-			close(rwError)
+		//read deadlines of the exclusive connection are left behind by the reader
+		if reuse && pc.mux == nil && c.timeouts != (Timeouts{}) {
+			reuse = pc.netConn.SetDeadline(time.Time{}) == nil
+		}
+
+		c.pool.put(pc, reuse)
+
+		if owned {
+			req.body.remove()
+		}
+		resp.finish(failure)
 	}()
 
 	return
 }
 
-func (c *client) Close() (err error) {
-	if c.conn == nil {
-		return
-	}
-
-	err = c.conn.Close()
-	c.conn = nil
+//Close closes idle connections and stops the pool, connections in use are closed once
+//their requests complete.
+func (c *Client) Close() error {
+	return c.pool.close()
+}
 
-	return err
+//stdoutWriter is written by the connection reader, see io.PipeWriter.
+type stdoutWriter interface {
+	io.WriteCloser
+	CloseWithError(err error) error
 }
 
 type ResponsePipe struct {
 	stdOutReader io.Reader
-	stdOutWriter io.WriteCloser
+	stdOutWriter stdoutWriter
 	stdErrReader io.Reader
 	stdErrWriter io.WriteCloser
+
+	//output is flushed as it is read in streaming mode, buffer is set in buffered mode
+	mode   ResponseMode
+	buffer *responseBuffer
+
+	//name of the backend serving the request
+	backend string
+
+	//files pointed to by the response are served to the raw request when set
+	sendfile *SendfileConfig
+	raw      *http.Request
+
+	//local redirects are reported instead of being sent to the client
+	localRedirects bool
+
+	limits HeaderLimits
+
+	mu  sync.Mutex
+	end *EndRequest
+
+	//client side failure, set before done is closed
+	err  error
+	done chan struct{}
+
+	//called once the request is complete, see onFinish
+	finished bool
+	hooks    []func(err error)
+
+	//closed once the backend sent stdout or stderr, see started
+	output     chan struct{}
+	outputOnce sync.Once
+	outputAt   time.Time
 }
 
 func NewResponsePipe() (p *ResponsePipe) {
 	p = new(ResponsePipe)
 	p.stdOutReader, p.stdOutWriter = io.Pipe()
 	p.stdErrReader, p.stdErrWriter = io.Pipe()
+	p.done = make(chan struct{})
+	p.output = make(chan struct{})
 
 	return
 }
@@ -206,6 +472,107 @@ func (pipes *ResponsePipe) Close() {
 	_ = pipes.stdErrWriter.Close()
 }
 
+//closeWithError makes reader of the stdout fail with given error instead of reaching EOF.
+func (pipes *ResponsePipe) closeWithError(err error) {
+	_ = pipes.stdOutWriter.CloseWithError(err)
+}
+
+//EndRequest returns result reported by the backend, nil until request has been ended. Result is
+//known by the time stdout is drained.
+func (pipes *ResponsePipe) EndRequest() *EndRequest {
+	pipes.mu.Lock()
+	defer pipes.mu.Unlock()
+
+	return pipes.end
+}
+
+func (pipes *ResponsePipe) setEndRequest(end *EndRequest) {
+	pipes.mu.Lock()
+	defer pipes.mu.Unlock()
+
+	pipes.end = end
+}
+
+//Backend returns name of the backend serving the request, see OptionName.
+func (pipes *ResponsePipe) Backend() string {
+	return pipes.backend
+}
+
+//Err waits until request is complete and returns the failure of the client, *AbortError is
+//returned for the requests aborted because of their context.
+func (pipes *ResponsePipe) Err() error {
+	<-pipes.done
+
+	return pipes.err
+}
+
+func (pipes *ResponsePipe) finish(err error) {
+	pipes.mu.Lock()
+	pipes.err, pipes.finished = err, true
+	hooks := pipes.hooks
+	pipes.mu.Unlock()
+
+	for _, fn := range hooks {
+		fn(err)
+	}
+
+	close(pipes.done)
+}
+
+//outputStarted marks that the backend started to send stdout or stderr.
+func (pipes *ResponsePipe) outputStarted() {
+	pipes.outputOnce.Do(func() {
+		pipes.mu.Lock()
+		pipes.outputAt = time.Now()
+		pipes.mu.Unlock()
+
+		close(pipes.output)
+	})
+}
+
+//firstByte returns time the backend started to send output, zero when there was none.
+func (pipes *ResponsePipe) firstByte() time.Time {
+	pipes.mu.Lock()
+	defer pipes.mu.Unlock()
+
+	return pipes.outputAt
+}
+
+//started waits until the backend starts to send output or the request is complete, it reports
+//whether there was any output. Nothing has been passed to the client when there was none, so
+//the request can be sent elsewhere.
+func (pipes *ResponsePipe) started() bool {
+	select {
+		case <-pipes.output:
+			return true
+		case <-pipes.done:
+	}
+
+	select {
+		case <-pipes.output:
+			return true
+		default:
+			return false
+	}
+}
+
+//onFinish calls fn with the failure of the client once the request is complete, before Err
+//returns. It is called right away when the request is complete already.
+func (pipes *ResponsePipe) onFinish(fn func(err error)) {
+	pipes.mu.Lock()
+	if !pipes.finished {
+		pipes.hooks = append(pipes.hooks, fn)
+		pipes.mu.Unlock()
+
+		return
+	}
+
+	err := pipes.err
+	pipes.mu.Unlock()
+
+	fn(err)
+}
+
 func (pipes *ResponsePipe) WriteTo(rw http.ResponseWriter, ew io.Writer) (err error) {
 	chErr := make(chan error, 2)
 	defer close(chErr)
@@ -215,6 +582,13 @@ func (pipes *ResponsePipe) WriteTo(rw http.ResponseWriter, ew io.Writer) (err er
 
 	go func() {
 		chErr <- pipes.writeResponse(rw)
+
+		//rest of the response is discarded so the request can complete
+		_, _ = io.Copy(ioutil.Discard, pipes.stdOutReader)
+		if pipes.buffer != nil {
+			pipes.buffer.remove()
+		}
+
 		wg.Done()
 	}()
 
@@ -244,25 +618,38 @@ func (pipes *ResponsePipe) writeError(w io.Writer) (err error) {
 }
 
 func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
-	lineBody := bufio.NewReaderSize(pipes.stdOutReader, 1024)
+	lineBody := bufio.NewReaderSize(pipes.stdOutReader, 4096)
 	headers := make(http.Header)
 	statusCode := 0
 	headerLines := 0
+	headerSize := 0
 	sawBlankLine := false
 
+	//header the continuation lines belong to
+	last := ""
+
 	for {
 		var line []byte
-		var isPrefix bool
 
-		line, isPrefix, err = lineBody.ReadLine()
-		if isPrefix {
-			w.WriteHeader(http.StatusInternalServerError)
-			err = fmt.Errorf("gofast: long header line from subprocess")
+		line, err = readHeaderLine(lineBody, pipes.limits.maxLine())
+		if err == io.EOF {
+			break
+		}
+
+		if err == nil {
+			if headerSize += len(line); headerSize > pipes.limits.maxSize() {
+				err = ErrHeaderTooLarge
+			}
+		}
+
+		if err == ErrHeaderLineTooLong || err == ErrHeaderTooLarge {
+			w.WriteHeader(http.StatusBadGateway)
 			return
 		}
 
-		if err == io.EOF {
-			break
+		if _, ok := err.(*TimeoutError); ok {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
 		}
 
 		if err != nil {
@@ -276,6 +663,14 @@ func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
 			break
 		}
 
+		//obsolete line folding continues value of the previous header
+		if line[0] == ' ' || line[0] == '\t' {
+			if values := headers[last]; len(values) != 0 {
+				values[len(values)-1] += " " + strings.TrimSpace(string(line))
+				continue
+			}
+		}
+
 		headerLines++
 		parts := strings.SplitN(string(line), ":", 2)
 		if len(parts) < 2 {
@@ -303,18 +698,35 @@ func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
 				}
 
 				statusCode = code
+				last = ""
 			default:
 				headers.Add(header, val)
+				last = http.CanonicalHeaderKey(header)
 		}
 	}
 
 	if headerLines == 0 || !sawBlankLine {
+		//backend might have rejected the request
+		if end := pipes.EndRequest(); end != nil && end.Err() != nil {
+			err = end.Err()
+			w.WriteHeader(rejectedStatus(err))
+			return
+		}
+
 		w.WriteHeader(http.StatusInternalServerError)
 		err = fmt.Errorf("gofast: no headers")
 		return
 	}
 
 	if loc := headers.Get("Location"); loc != "" {
+		if statusCode == 0 && pipes.localRedirects && isLocalPath(loc) {
+			//local redirect has no body, nothing is written so the server can serve the location
+			if _, err = lineBody.Peek(1); err == io.EOF {
+				err = &LocalRedirect{Location: loc}
+				return
+			}
+		}
+
 		if statusCode == 0 {
 			statusCode = http.StatusFound
 		}
@@ -330,6 +742,26 @@ func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
 		statusCode = http.StatusOK
 	}
 
+	if pipes.sendfile != nil && pipes.raw != nil {
+		var filename string
+		//body of the application is not needed, it is discarded by WriteTo
+		if filename, err = pipes.sendfile.target(headers); err == nil && filename != "" {
+			err = serveFile(w, pipes.raw, headers, filename)
+		}
+
+		if err != nil {
+			w.WriteHeader(sendfileStatus(err))
+			return
+		}
+
+		if filename != "" {
+			return
+		}
+	}
+
+	streaming := pipes.mode == ResponseStreaming || strings.EqualFold(headers.Get(headerAccelBuffering), "no")
+	headers.Del(headerAccelBuffering)
+
 	for k, vv := range headers {
 		for _, v := range vv {
 			w.Header().Add(k, v)
@@ -337,7 +769,18 @@ func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
 	}
 
 	w.WriteHeader(statusCode)
-	_, err = io.Copy(w, lineBody)
+
+	var out io.Writer = w
+	if f, ok := w.(http.Flusher); ok && streaming {
+		f.Flush()
+		out = &flushWriter{w: w, f: f}
+	}
+
+	_, err = io.Copy(out, lineBody)
+
+	if _, ok := err.(*TimeoutError); ok {
+		return
+	}
 
 	if err != nil {
 		err = fmt.Errorf("gofast: copy error: %v", err)
@@ -345,3 +788,44 @@ func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
 
 	return
 }
+
+//readHeaderLine reads line of the header block without the line ending, line longer than limit
+//fails with ErrHeaderLineTooLong. Last line does not have to be terminated.
+func readHeaderLine(r *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+
+		if len(bytes.TrimRight(line, "\r\n")) > limit {
+			return nil, ErrHeaderLineTooLong
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err == io.EOF && len(line) != 0 {
+			err = nil
+		}
+
+		return bytes.TrimRight(line, "\r\n"), err
+	}
+}
+
+//isLocalPath reports whether location is path of the local resource rather than absolute URL.
+func isLocalPath(location string) bool {
+	return strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//")
+}
+
+//rejectedStatus returns http status for the request rejected by the backend.
+func rejectedStatus(err error) int {
+	switch err {
+		case ErrOverloaded, ErrCantMultiplex:
+			return http.StatusServiceUnavailable
+
+		default:
+			return http.StatusInternalServerError
+	}
+}
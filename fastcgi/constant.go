@@ -1,5 +1,7 @@
 package fastcgi
 
+import "errors"
+
 type recType uint8
 
 const version  uint8 = 1
@@ -24,7 +26,7 @@ func (t recType) String() string {
 		return "FCGI_BEGIN_REQUEST"
 
 	case typeAbortRequest:
-		return "FCGI_BEGIN_REQUEST"
+		return "FCGI_ABORT_REQUEST"
 
 	case typeEndRequest:
 		return "FCGI_END_REQUEST"
@@ -72,6 +74,8 @@ const (
 const (
 	//role type
 	RoleResponder uint16 = iota + 1
+	RoleAuthorizer
+	RoleFilter
 )
 
 const (
@@ -81,3 +85,14 @@ const (
 	statusOverloaded
 	statusUnknownRole
 )
+
+var (
+	//ErrCantMultiplex reported when backend rejects concurrent request over the same connection.
+	ErrCantMultiplex = errors.New("gofast: backend can not multiplex connection")
+
+	//ErrOverloaded reported when backend runs out of resources to serve the request.
+	ErrOverloaded = errors.New("gofast: backend is overloaded")
+
+	//ErrUnknownRole reported when backend does not support requested role.
+	ErrUnknownRole = errors.New("gofast: backend does not support requested role")
+)
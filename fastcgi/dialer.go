@@ -0,0 +1,54 @@
+package fastcgi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+//Dialer opens new connection to the FastCGI backend.
+type Dialer func(ctx context.Context) (net.Conn, error)
+
+//NewDialer creates dialer for the given address. Address can be provided as tcp://host:port or
+//unix:///path/to/socket, addresses without scheme are treated as unix socket path when starting
+//with slash and as tcp host:port otherwise.
+func NewDialer(address string) (Dialer, error) {
+	network, addr, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &net.Dialer{}
+
+	return func(ctx context.Context) (net.Conn, error) {
+		return d.DialContext(ctx, network, addr)
+	}, nil
+}
+
+//parseAddress splits address into network and network specific address.
+func parseAddress(address string) (network string, addr string, err error) {
+	switch {
+		case strings.HasPrefix(address, "tcp://"):
+			network, addr = "tcp", strings.TrimPrefix(address, "tcp://")
+
+		case strings.HasPrefix(address, "unix://"):
+			network, addr = "unix", strings.TrimPrefix(address, "unix://")
+
+		case strings.Contains(address, "://"):
+			err = fmt.Errorf("gofast: unsupported network in address %q", address)
+			return
+
+		case strings.HasPrefix(address, "/"):
+			network, addr = "unix", address
+
+		default:
+			network, addr = "tcp", address
+	}
+
+	if addr == "" {
+		err = fmt.Errorf("gofast: empty address %q", address)
+	}
+
+	return
+}
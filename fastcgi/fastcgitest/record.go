@@ -0,0 +1,145 @@
+package fastcgitest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+//record types and statuses of the FastCGI specification
+const (
+	typeBeginRequest    uint8 = 1
+	typeAbortRequest    uint8 = 2
+	typeEndRequest      uint8 = 3
+	typeParams          uint8 = 4
+	typeStdin           uint8 = 5
+	typeStdout          uint8 = 6
+	typeStderr          uint8 = 7
+	typeData            uint8 = 8
+	typeGetValues       uint8 = 9
+	typeGetValuesResult uint8 = 10
+	typeUnknownType     uint8 = 11
+
+	//maximum record body
+	maxWrite = 65535
+
+	roleFilter = 3
+)
+
+//record is single FastCGI record.
+type record struct {
+	version uint8
+	typ     uint8
+	id      uint16
+	body    []byte
+}
+
+func readRecord(r io.Reader) (*record, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+
+	if h[0] != 1 {
+		return nil, errors.New("fastcgitest: invalid header version")
+	}
+
+	n := int(binary.BigEndian.Uint16(h[4:]))
+	b := make([]byte, n+int(h[6]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	return &record{
+		version: h[0],
+		typ:     h[1],
+		id:      binary.BigEndian.Uint16(h[2:]),
+		body:    b[:n],
+	}, nil
+}
+
+//encode returns record with the header and padding, version defaults to 1.
+func (rec *record) encode() []byte {
+	version := rec.version
+	if version == 0 {
+		version = 1
+	}
+
+	padding := -len(rec.body) & 7
+	b := make([]byte, 8, 8+len(rec.body)+padding)
+
+	b[0], b[1] = version, rec.typ
+	binary.BigEndian.PutUint16(b[2:], rec.id)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(rec.body)))
+	b[6] = uint8(padding)
+
+	b = append(b, rec.body...)
+
+	return append(b, make([]byte, padding)...)
+}
+
+//parsePairs decodes name-value pairs, malformed tail is ignored.
+func parsePairs(b []byte) map[string]string {
+	pairs := make(map[string]string)
+
+	for len(b) > 0 {
+		nameLen, n := readSize(b)
+		if n == 0 {
+			break
+		}
+
+		b = b[n:]
+
+		valueLen, n := readSize(b)
+		if n == 0 || uint64(nameLen)+uint64(valueLen) > uint64(len(b)-n) {
+			break
+		}
+
+		b = b[n:]
+		pairs[string(b[:nameLen])] = string(b[nameLen : nameLen+valueLen])
+		b = b[nameLen+valueLen:]
+	}
+
+	return pairs
+}
+
+func readSize(b []byte) (uint32, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+
+	if b[0]&0x80 == 0 {
+		return uint32(b[0]), 1
+	}
+
+	if len(b) < 4 {
+		return 0, 0
+	}
+
+	return binary.BigEndian.Uint32(b) &^ (1 << 31), 4
+}
+
+//encodePairs encodes name-value pairs.
+func encodePairs(pairs map[string]string) []byte {
+	var b []byte
+
+	for name, value := range pairs {
+		b = appendSize(b, len(name))
+		b = appendSize(b, len(value))
+		b = append(b, name...)
+		b = append(b, value...)
+	}
+
+	return b
+}
+
+func appendSize(b []byte, size int) []byte {
+	if size <= 127 {
+		return append(b, byte(size))
+	}
+
+	var s [4]byte
+	binary.BigEndian.PutUint32(s[:], uint32(size)|1<<31)
+
+	return append(b, s[:]...)
+}
@@ -0,0 +1,484 @@
+//Package fastcgitest provides fake FastCGI responder scripted by the tests, so the client can be
+//tested without php-fpm.
+package fastcgitest
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Fault breaks the protocol while responding.
+type Fault int
+
+const (
+	//FaultNone ends the request as usual.
+	FaultNone Fault = iota
+
+	//FaultBadVersion sends record with unsupported protocol version instead of the end of the request.
+	FaultBadVersion
+
+	//FaultTruncated sends record shorter than its header says and closes the connection.
+	FaultTruncated
+
+	//FaultClose closes the connection instead of ending the request.
+	FaultClose
+
+	//FaultWrongID sends stdout record of the request which does not exist.
+	FaultWrongID
+
+	//FaultHang never ends the request, connection stays open.
+	FaultHang
+)
+
+//Request is request received by the server.
+type Request struct {
+	ID       uint16
+	Role     uint16
+	KeepConn bool
+	Params   map[string]string
+	Stdin    []byte
+	Data     []byte
+
+	params  []byte
+	started bool
+	aborted chan struct{}
+	once    sync.Once
+}
+
+//Aborted returns channel closed once the request has been aborted by the client.
+func (r *Request) Aborted() <-chan struct{} {
+	return r.aborted
+}
+
+//Response scripts reply to the request.
+type Response struct {
+	//Status is sent as Status header unless zero.
+	Status int
+
+	//Header is sent before stdout, header block is left out when both Status and Header are
+	//empty so raw output can be scripted.
+	Header http.Header
+
+	//Stdout is sent after the header block, chunk by chunk.
+	Stdout [][]byte
+
+	//Stderr is sent before stdout.
+	Stderr [][]byte
+
+	//Delay before the first record and between the chunks.
+	Delay      time.Duration
+	ChunkDelay time.Duration
+
+	//AppStatus and ProtocolStatus of FCGI_END_REQUEST.
+	AppStatus      uint32
+	ProtocolStatus uint8
+
+	//IgnoreAbort keeps responding after FCGI_ABORT_REQUEST, request is ended right away otherwise.
+	IgnoreAbort bool
+
+	//Fault breaks the protocol instead of ending the request.
+	Fault Fault
+}
+
+//Handler scripts response of the request.
+type Handler func(req *Request) *Response
+
+//Server is fake FastCGI responder, requests are served concurrently and multiplexing is supported.
+type Server struct {
+	handler Handler
+
+	//Values are reported to FCGI_GET_VALUES, variables not listed are left out of the reply.
+	Values map[string]string
+
+	listener net.Listener
+	dir      string
+
+	mu       sync.Mutex
+	requests []*Request
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+//NewServer starts the server on temporary unix socket.
+func NewServer(handler Handler) *Server {
+	dir, err := ioutil.TempDir("", "fastcgitest")
+	if err != nil {
+		panic(fmt.Sprintf("fastcgitest: failed to create socket directory: %v", err))
+	}
+
+	l, err := net.Listen("unix", filepath.Join(dir, "fcgi.sock"))
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		panic(fmt.Sprintf("fastcgitest: failed to listen: %v", err))
+	}
+
+	srv := newServer(handler)
+	srv.listener, srv.dir = l, dir
+
+	go srv.accept()
+
+	return srv
+}
+
+//NewPipeServer creates the server without listener, every Dial serves new in-memory connection.
+func NewPipeServer(handler Handler) *Server {
+	return newServer(handler)
+}
+
+func newServer(handler Handler) *Server {
+	if handler == nil {
+		handler = func(req *Request) *Response {
+			return &Response{Status: http.StatusOK}
+		}
+	}
+
+	return &Server{
+		handler: handler,
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+//Address returns address of the socket in format accepted by fastcgi.NewDialer, empty for pipe server.
+func (srv *Server) Address() string {
+	if srv.listener == nil {
+		return ""
+	}
+
+	return "unix://" + srv.listener.Addr().String()
+}
+
+//Dial opens connection to the server, it can be used as fastcgi.Dialer.
+func (srv *Server) Dial(ctx context.Context) (net.Conn, error) {
+	if srv.listener != nil {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", srv.listener.Addr().String())
+	}
+
+	client, server := net.Pipe()
+	if !srv.track(server) {
+		_ = client.Close()
+		return nil, fmt.Errorf("fastcgitest: server closed")
+	}
+
+	go srv.serve(server)
+
+	return client, nil
+}
+
+//Requests returns requests received so far, in order they have been started.
+func (srv *Server) Requests() []*Request {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return append([]*Request(nil), srv.requests...)
+}
+
+//Close stops the server and closes all connections.
+func (srv *Server) Close() {
+	srv.mu.Lock()
+	srv.closed = true
+	for c := range srv.conns {
+		_ = c.Close()
+	}
+	srv.mu.Unlock()
+
+	if srv.listener != nil {
+		_ = srv.listener.Close()
+		_ = os.RemoveAll(srv.dir)
+	}
+}
+
+func (srv *Server) accept() {
+	for {
+		c, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		if !srv.track(c) {
+			_ = c.Close()
+			return
+		}
+
+		go srv.serve(c)
+	}
+}
+
+func (srv *Server) track(c net.Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closed {
+		return false
+	}
+
+	srv.conns[c] = struct{}{}
+
+	return true
+}
+
+//serverConn serves records of single connection.
+type serverConn struct {
+	srv *Server
+	c   net.Conn
+
+	wmu sync.Mutex
+
+	mu   sync.Mutex
+	reqs map[uint16]*Request
+}
+
+func (srv *Server) serve(c net.Conn) {
+	sc := &serverConn{
+		srv:  srv,
+		c:    c,
+		reqs: make(map[uint16]*Request),
+	}
+
+	defer func() {
+		_ = c.Close()
+
+		srv.mu.Lock()
+		delete(srv.conns, c)
+		srv.mu.Unlock()
+	}()
+
+	for {
+		rec, err := readRecord(c)
+		if err != nil {
+			return
+		}
+
+		sc.handle(rec)
+	}
+}
+
+func (sc *serverConn) handle(rec *record) {
+	if rec.id == 0 {
+		if rec.typ != typeGetValues {
+			body := make([]byte, 8)
+			body[0] = rec.typ
+			sc.write(&record{typ: typeUnknownType, body: body})
+
+			return
+		}
+
+		values := make(map[string]string)
+		for name := range parsePairs(rec.body) {
+			if value, ok := sc.srv.Values[name]; ok {
+				values[name] = value
+			}
+		}
+
+		sc.write(&record{typ: typeGetValuesResult, body: encodePairs(values)})
+
+		return
+	}
+
+	sc.mu.Lock()
+	req := sc.reqs[rec.id]
+	sc.mu.Unlock()
+
+	switch rec.typ {
+		case typeBeginRequest:
+			if len(rec.body) < 8 {
+				return
+			}
+
+			req = &Request{
+				ID:       rec.id,
+				Role:     binary.BigEndian.Uint16(rec.body),
+				KeepConn: rec.body[2]&1 != 0,
+				aborted:  make(chan struct{}),
+			}
+
+			sc.mu.Lock()
+			sc.reqs[rec.id] = req
+			sc.mu.Unlock()
+
+		case typeParams:
+			if req != nil {
+				req.params = append(req.params, rec.body...)
+				if len(rec.body) == 0 {
+					req.Params = parsePairs(req.params)
+				}
+			}
+
+		case typeStdin:
+			if req != nil {
+				req.Stdin = append(req.Stdin, rec.body...)
+				if len(rec.body) == 0 && req.Role != roleFilter {
+					sc.start(req)
+				}
+			}
+
+		case typeData:
+			if req != nil {
+				req.Data = append(req.Data, rec.body...)
+				if len(rec.body) == 0 {
+					sc.start(req)
+				}
+			}
+
+		case typeAbortRequest:
+			if req == nil {
+				return
+			}
+
+			req.once.Do(func() {
+				close(req.aborted)
+			})
+
+			//request which has not been started yet is not going to be
+			if !req.started {
+				sc.end(req, 0, 0)
+			}
+	}
+}
+
+//start records the request and responds to it.
+func (sc *serverConn) start(req *Request) {
+	req.started = true
+
+	sc.srv.mu.Lock()
+	sc.srv.requests = append(sc.srv.requests, req)
+	sc.srv.mu.Unlock()
+
+	go sc.respond(req, sc.srv.handler(req))
+}
+
+func (sc *serverConn) respond(req *Request, resp *Response) {
+	if resp == nil {
+		resp = &Response{}
+	}
+
+	if !sc.wait(req, resp, resp.Delay) {
+		return
+	}
+
+	for _, chunk := range resp.Stderr {
+		sc.writeStream(typeStderr, req.ID, chunk)
+	}
+
+	if head := header(resp); head != "" {
+		sc.writeStream(typeStdout, req.ID, []byte(head))
+	}
+
+	for i, chunk := range resp.Stdout {
+		if i > 0 && !sc.wait(req, resp, resp.ChunkDelay) {
+			return
+		}
+
+		sc.writeStream(typeStdout, req.ID, chunk)
+	}
+
+	switch resp.Fault {
+		case FaultBadVersion:
+			sc.write(&record{version: 2, typ: typeStdout, id: req.ID, body: []byte("bad version")})
+
+		case FaultTruncated:
+			b := (&record{typ: typeStdout, id: req.ID, body: []byte("truncated record")}).encode()
+
+			sc.wmu.Lock()
+			_, _ = sc.c.Write(b[:12])
+			sc.wmu.Unlock()
+
+			_ = sc.c.Close()
+
+		case FaultClose:
+			_ = sc.c.Close()
+
+		case FaultWrongID:
+			sc.write(&record{typ: typeStdout, id: req.ID + 1000, body: []byte("wrong id")})
+
+		case FaultHang:
+			//never ends
+
+		default:
+			sc.end(req, resp.AppStatus, resp.ProtocolStatus)
+	}
+}
+
+//wait sleeps for given duration, request is ended when it has been aborted meanwhile.
+func (sc *serverConn) wait(req *Request, resp *Response, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	abort := req.aborted
+	if resp.IgnoreAbort {
+		abort = nil
+	}
+
+	select {
+		case <-time.After(d):
+			return true
+
+		case <-abort:
+			sc.end(req, 0, 0)
+			return false
+	}
+}
+
+func (sc *serverConn) end(req *Request, appStatus uint32, protocolStatus uint8) {
+	sc.mu.Lock()
+	delete(sc.reqs, req.ID)
+	sc.mu.Unlock()
+
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint32(body, appStatus)
+	body[4] = protocolStatus
+
+	sc.write(&record{typ: typeStdout, id: req.ID})
+	sc.write(&record{typ: typeEndRequest, id: req.ID, body: body})
+
+	if !req.KeepConn {
+		_ = sc.c.Close()
+	}
+}
+
+//writeStream sends data split into records, stream is closed by end.
+func (sc *serverConn) writeStream(typ uint8, id uint16, b []byte) {
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxWrite {
+			n = maxWrite
+		}
+
+		sc.write(&record{typ: typ, id: id, body: b[:n]})
+		b = b[n:]
+	}
+}
+
+func (sc *serverConn) write(rec *record) {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+
+	_, _ = sc.c.Write(rec.encode())
+}
+
+//header formats CGI header block of the response.
+func header(resp *Response) string {
+	if resp.Status == 0 && len(resp.Header) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	if resp.Status != 0 {
+		fmt.Fprintf(&b, "Status: %d %s\r\n", resp.Status, http.StatusText(resp.Status))
+	}
+
+	_ = resp.Header.Write(&b)
+	b.WriteString("\r\n")
+
+	return b.String()
+}
@@ -0,0 +1,114 @@
+package fastcgi
+
+import (
+	"fast-php/fastcgi/fastcgitest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProtocolFaults(t *testing.T) {
+	faults := map[string]fastcgitest.Fault{
+		"bad version": fastcgitest.FaultBadVersion,
+		"truncated":   fastcgitest.FaultTruncated,
+		"wrong id":    fastcgitest.FaultWrongID,
+		"closed":      fastcgitest.FaultClose,
+	}
+
+	for name, fault := range faults {
+		for _, multiplex := range []bool{false, true} {
+			fault, multiplex, sub := fault, multiplex, name
+			if multiplex {
+				sub += " multiplexed"
+			}
+
+			t.Run(sub, func(t *testing.T) {
+				srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+					if req.Params["REQUEST_URI"] == "/ok" {
+						return &fastcgitest.Response{Status: 200, Stdout: [][]byte{[]byte("ok")}}
+					}
+
+					return &fastcgitest.Response{
+						Status: 200,
+						Header: http.Header{"Content-Type": {"text/plain"}},
+						Stdout: [][]byte{[]byte("partial")},
+						Fault:  fault,
+					}
+				})
+				srv.Values = map[string]string{ValueMpxsConns: "1"}
+				defer srv.Close()
+
+				c := NewClient(srv.Dial, PoolConfig{Multiplex: multiplex})
+				defer c.Close()
+
+				resp, err := c.Do(NewRequest(httptest.NewRequest("GET", "/fault", nil)))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				go resp.WriteTo(httptest.NewRecorder(), ioutil.Discard)
+
+				select {
+					case <-resp.done:
+						if resp.Err() == nil {
+							t.Fatal("broken response passed as complete")
+						}
+
+					case <-time.After(2 * time.Second):
+						t.Fatal("request did not fail")
+				}
+
+				//broken connection is not reused
+				if body, err := get(c, "/ok"); err != nil || body != "ok" {
+					t.Fatalf("body %q, error %v", body, err)
+				}
+			})
+		}
+	}
+}
+
+func TestRejectedRequest(t *testing.T) {
+	cases := []struct {
+		name   string
+		status uint8
+		err    error
+		code   int
+	}{
+		{name: "can not multiplex", status: statusCantMultiplex, err: ErrCantMultiplex, code: http.StatusServiceUnavailable},
+		{name: "overloaded", status: statusOverloaded, err: ErrOverloaded, code: http.StatusServiceUnavailable},
+		{name: "unknown role", status: statusUnknownRole, err: ErrUnknownRole, code: http.StatusInternalServerError},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			status := c.status
+			srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+				return &fastcgitest.Response{ProtocolStatus: status}
+			})
+			defer srv.Close()
+
+			client := NewClient(srv.Dial, PoolConfig{})
+			defer client.Close()
+
+			resp, err := client.Do(NewRequest(httptest.NewRequest("GET", "/", nil)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			if err := resp.WriteTo(rec, ioutil.Discard); err != c.err {
+				t.Fatalf("error = %v, want %v", err, c.err)
+			}
+
+			if end := resp.EndRequest(); end == nil || end.ProtocolStatus != c.status || end.Err() != c.err {
+				t.Fatalf("end request %+v", end)
+			}
+
+			if rec.Code != c.code {
+				t.Fatalf("status = %d, want %d", rec.Code, c.code)
+			}
+		})
+	}
+}
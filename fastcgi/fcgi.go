@@ -61,6 +61,10 @@ type conn struct {
 	//to avoid allocations
 	buf bytes.Buffer
 	h   header
+
+	//tracers of the requests, see trace
+	traceMu sync.Mutex
+	traces  map[uint16]*Tracer
 }
 
 func newConn(rwc io.ReadWriteCloser) *conn {
@@ -97,9 +101,50 @@ func (c *conn) writeRecord(recType recType, reqID uint16, b []byte) error {
 
 	_, err := c.rwc.Write(c.buf.Bytes())
 
+	if t := c.tracer(reqID); t != nil {
+		t.record(traceSend, &c.h, b)
+	}
+
 	return err
 }
 
+//readRecord reads next record from the connection.
+func (c *conn) readRecord(rec *serviceRecord) error {
+	if err := rec.read(c.rwc); err != nil {
+		return err
+	}
+
+	if t := c.tracer(rec.h.ID); t != nil {
+		t.record(traceRecv, &rec.h, rec.body())
+	}
+
+	return nil
+}
+
+//trace dumps records of the request using given tracer, nil stops the tracing.
+func (c *conn) trace(reqID uint16, t *Tracer) {
+	c.traceMu.Lock()
+	defer c.traceMu.Unlock()
+
+	if t == nil {
+		delete(c.traces, reqID)
+		return
+	}
+
+	if c.traces == nil {
+		c.traces = make(map[uint16]*Tracer)
+	}
+
+	c.traces[reqID] = t
+}
+
+func (c *conn) tracer(reqID uint16) *Tracer {
+	c.traceMu.Lock()
+	defer c.traceMu.Unlock()
+
+	return c.traces[reqID]
+}
+
 func (c *conn) writeBeginRequest(reqID uint16, role uint16, flags uint8) error {
 	b := [8]byte{
 		byte(role >> 8),
@@ -122,23 +167,24 @@ func (c *conn) writeAbortRequest(reqID uint16) error {
 	return c.writeRecord(typeAbortRequest, reqID, nil)
 }
 
-func (c *conn) writePairs(recType recType, reqID uint16, pairs map[string]string) error {
+//writePairs writes the pairs in order as single stream.
+func (c *conn) writePairs(recType recType, reqID uint16, pairs Params) error {
 	w := newWriter(c, recType, reqID)
 	b := make([]byte, 8)
 
-	for k, v := range pairs {
-		n := encodeSize(b, uint32(len(k)))
-		n += encodeSize(b[n:], uint32(len(v)))
+	for _, pair := range pairs {
+		n := encodeSize(b, uint32(len(pair.Name)))
+		n += encodeSize(b[n:], uint32(len(pair.Value)))
 
 		if _, err := w.Write(b[:n]); err != nil {
 			return err
 		}
 
-		if _, err := w.WriteString(k); err != nil {
+		if _, err := w.WriteString(pair.Name); err != nil {
 			return err
 		}
 
-		if _, err := w.WriteString(v); err != nil {
+		if _, err := w.WriteString(pair.Value); err != nil {
 			return err
 		}
 	}
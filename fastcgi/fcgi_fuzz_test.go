@@ -0,0 +1,109 @@
+// +build go1.18
+
+package fastcgi
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+//FuzzRecordRead reads records from arbitrary input, every record read must fit into the buffer and
+//be written back unchanged apart from the padding.
+func FuzzRecordRead(f *testing.F) {
+	f.Add(rawRecord(1, typeStdout, 1, []byte("Status: 200 OK\r\n\r\n"), 6))
+	f.Add(rawRecord(1, typeEndRequest, 1, []byte{0, 0, 0, 0, 0, 0, 0, 0}, 0))
+	f.Add(rawRecord(1, 42, 0, nil, maxPad))
+	f.Add(rawRecord(2, typeStdout, 1, []byte("x"), 7))
+	f.Add(rawRecord(1, typeStdout, 1, []byte("body"), 4)[:10])
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		r := bytes.NewReader(input)
+
+		var rec serviceRecord
+		for rec.read(r) == nil {
+			body := rec.body()
+			if len(body) > maxWrite {
+				t.Fatalf("body of %d bytes", len(body))
+			}
+
+			c := &bufConn{}
+			if err := newConn(c).writeRecord(rec.h.Type, rec.h.ID, body); err != nil {
+				t.Fatal(err)
+			}
+
+			var again serviceRecord
+			if err := again.read(c); err != nil {
+				t.Fatal(err)
+			}
+
+			if again.h.Type != rec.h.Type || again.h.ID != rec.h.ID || !bytes.Equal(again.body(), body) {
+				t.Fatalf("record changed by the round trip")
+			}
+		}
+	})
+}
+
+//FuzzReadSize checks that lengths decoded from arbitrary input encode back to the same bytes.
+func FuzzReadSize(f *testing.F) {
+	f.Add([]byte{0x7f})
+	f.Add([]byte{0x80, 0, 0, 0x80})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x80, 0, 0})
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		size, n := readSize(input)
+		if n == 0 {
+			if len(input) != 0 && (input[0]&0x80 == 0 || len(input) >= 4) {
+				t.Fatalf("readSize(%x) failed", input)
+			}
+
+			return
+		}
+
+		if n != 1 && n != 4 || size >= 1<<31 {
+			t.Fatalf("readSize(%x) = %d, %d", input, size, n)
+		}
+
+		b := make([]byte, 4)
+		m := encodeSize(b, size)
+
+		//sizes up to 127 may be encoded by four bytes as well, encoder always uses the short form
+		if n == 1 || size > 127 {
+			if !bytes.Equal(b[:m], input[:n]) {
+				t.Fatalf("encodeSize(%d) = %x, decoded from %x", size, b[:m], input[:n])
+			}
+		}
+	})
+}
+
+//FuzzParsePairs parses arbitrary name-value pairs, pairs parsed successfully must survive
+//writePairs split into records.
+func FuzzParsePairs(f *testing.F) {
+	f.Add([]byte("\x0bSCRIPT_NAME\x0a/index.php"))
+	f.Add(append([]byte("\x01\x80\x00\x00\x80N"), bytes.Repeat([]byte{'v'}, 128)...))
+	f.Add([]byte("\x01\xff\xff\xff\xffAB"))
+	f.Add([]byte("\xff\xff\xff\xff\xff\xff\xff\xffAB"))
+	f.Add([]byte("\x01\x80\x00"))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		pairs, err := parseParams(input)
+		if err != nil {
+			return
+		}
+
+		c := &bufConn{}
+		if err := newConn(c).writePairs(typeParams, 1, pairs); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := parseParams(readStream(t, c, typeParams))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != len(pairs) || len(got) != 0 && !reflect.DeepEqual(got, pairs) {
+			t.Fatalf("pairs changed by the round trip")
+		}
+	})
+}
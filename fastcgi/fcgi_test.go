@@ -0,0 +1,451 @@
+package fastcgi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//bufConn collects written records in memory.
+type bufConn struct {
+	bytes.Buffer
+}
+
+func (c *bufConn) Close() error {
+	return nil
+}
+
+//rawRecord encodes the record by hand, so the reader is not tested against the writer only.
+func rawRecord(ver uint8, recType recType, reqID uint16, body []byte, padding uint8) []byte {
+	b := make([]byte, 8, 8+len(body)+int(padding))
+	b[0], b[1] = ver, byte(recType)
+	binary.BigEndian.PutUint16(b[2:], reqID)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(body)))
+	b[6] = padding
+
+	b = append(b, body...)
+
+	return append(b, make([]byte, padding)...)
+}
+
+//readStream reads records of the stream up to the empty one and joins their bodies.
+func readStream(t *testing.T, r io.Reader, recType recType) []byte {
+	t.Helper()
+
+	var (
+		rec  serviceRecord
+		body []byte
+	)
+
+	for {
+		if err := rec.read(r); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+
+		if rec.h.Type != recType {
+			t.Fatalf("type = %v, want %v", rec.h.Type, recType)
+		}
+
+		if rec.h.ContentLength > maxWrite || int(rec.h.PaddingLength) != -int(rec.h.ContentLength)&7 {
+			t.Fatalf("content %d padding %d", rec.h.ContentLength, rec.h.PaddingLength)
+		}
+
+		if rec.h.ContentLength == 0 {
+			return body
+		}
+
+		body = append(body, rec.body()...)
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 7, 8, 9, 127, 128, 255, 256, 4096, maxWrite - 1, maxWrite} {
+		body := bytes.Repeat([]byte{'x'}, size)
+
+		c := &bufConn{}
+		if err := newConn(c).writeRecord(typeStdout, 1, body); err != nil {
+			t.Fatalf("%d: write: %v", size, err)
+		}
+
+		padding := -size & 7
+		if c.Len() != 8+size+padding {
+			t.Fatalf("%d: record is %d bytes, want %d", size, c.Len(), 8+size+padding)
+		}
+
+		if raw := rawRecord(version, typeStdout, 1, body, uint8(padding)); !bytes.Equal(c.Bytes(), raw) {
+			t.Fatalf("%d: record differs from the specification", size)
+		}
+
+		var rec serviceRecord
+		if err := rec.read(c); err != nil {
+			t.Fatalf("%d: read: %v", size, err)
+		}
+
+		if rec.h.Type != typeStdout || rec.h.ID != 1 || !bytes.Equal(rec.body(), body) {
+			t.Fatalf("%d: got %v id %d with %d bytes", size, rec.h.Type, rec.h.ID, len(rec.body()))
+		}
+
+		if c.Len() != 0 {
+			t.Fatalf("%d: %d bytes left unread", size, c.Len())
+		}
+	}
+}
+
+func TestRecordRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		recType recType
+		id      uint16
+		body    string
+		err     string
+	}{
+		{
+			name:    "no padding",
+			input:   rawRecord(1, typeStdout, 1, []byte("12345678"), 0),
+			recType: typeStdout,
+			id:      1,
+			body:    "12345678",
+		},
+		{
+			name:    "maximum padding",
+			input:   rawRecord(1, typeStderr, 2, []byte("abc"), maxPad),
+			recType: typeStderr,
+			id:      2,
+			body:    "abc",
+		},
+		{
+			name:    "padding only",
+			input:   rawRecord(1, typeStdout, 3, nil, 8),
+			recType: typeStdout,
+			id:      3,
+		},
+		{
+			name:    "maximum record",
+			input:   rawRecord(1, typeStdout, 65535, bytes.Repeat([]byte{'y'}, maxWrite), maxPad),
+			recType: typeStdout,
+			id:      65535,
+			body:    strings.Repeat("y", maxWrite),
+		},
+		{
+			name:    "unknown type",
+			input:   rawRecord(1, 42, 1, []byte("?"), 7),
+			recType: 42,
+			id:      1,
+			body:    "?",
+		},
+		{
+			name:  "bad version",
+			input: rawRecord(2, typeStdout, 1, []byte("x"), 7),
+			err:   "invalid header version",
+		},
+		{
+			name:  "empty",
+			input: nil,
+			err:   io.EOF.Error(),
+		},
+		{
+			name:  "truncated header",
+			input: rawRecord(1, typeStdout, 1, nil, 0)[:5],
+			err:   io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:  "truncated body",
+			input: rawRecord(1, typeStdout, 1, []byte("body"), 4)[:10],
+			err:   io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:  "truncated padding",
+			input: rawRecord(1, typeStdout, 1, []byte("body"), 4)[:13],
+			err:   io.ErrUnexpectedEOF.Error(),
+		},
+	}
+
+	for _, test := range tests {
+		var rec serviceRecord
+		err := rec.read(bytes.NewReader(test.input))
+
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: error = %v, want %s", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if rec.h.Type != test.recType || rec.h.ID != test.id || string(rec.body()) != test.body {
+			t.Errorf("%s: got %v id %d body %.20q", test.name, rec.h.Type, rec.h.ID, rec.body())
+		}
+	}
+}
+
+func TestRecordPaddingAlignment(t *testing.T) {
+	//padding of the first record must be skipped whatever its length is
+	input := append(rawRecord(1, typeStdout, 1, []byte("first"), 200), rawRecord(1, typeStdout, 1, []byte("second"), 2)...)
+	r := bytes.NewReader(input)
+
+	for _, want := range []string{"first", "second"} {
+		var rec serviceRecord
+		if err := rec.read(r); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(rec.body()) != want {
+			t.Fatalf("body = %q, want %q", rec.body(), want)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	tests := []struct {
+		size    uint32
+		encoded []byte
+	}{
+		{0, []byte{0}},
+		{1, []byte{1}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0, 0, 0x80}},
+		{255, []byte{0x80, 0, 0, 0xff}},
+		{65535, []byte{0x80, 0, 0xff, 0xff}},
+		{1<<31 - 1, []byte{0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for _, test := range tests {
+		b := make([]byte, 4)
+		n := encodeSize(b, test.size)
+		if !bytes.Equal(b[:n], test.encoded) {
+			t.Errorf("encodeSize(%d) = %x, want %x", test.size, b[:n], test.encoded)
+		}
+
+		size, n := readSize(test.encoded)
+		if size != test.size || n != len(test.encoded) {
+			t.Errorf("readSize(%x) = %d, %d", test.encoded, size, n)
+		}
+	}
+
+	for _, input := range [][]byte{nil, {0x80}, {0x80, 0}, {0xff, 0xff, 0xff}} {
+		if size, n := readSize(input); size != 0 || n != 0 {
+			t.Errorf("readSize(%x) = %d, %d, want truncated", input, size, n)
+		}
+	}
+}
+
+func TestPairsRoundTrip(t *testing.T) {
+	long := func(n int) string {
+		return strings.Repeat("v", n)
+	}
+
+	tests := []Params{
+		{},
+		{{"", ""}},
+		{{"EMPTY", ""}},
+		{{"SCRIPT_NAME", "/index.php"}, {"QUERY_STRING", "a=1&b=2"}},
+		{{"A", "1"}, {"B", "2"}, {"A", "3"}},
+		{{long(127), long(127)}},
+		{{long(128), long(128)}},
+		{{"SHORT", long(127)}, {"LONG", long(128)}},
+		//pair split between records
+		{{"BODY", long(maxWrite)}},
+		{{"A", long(maxWrite - 10)}, {"B", long(100)}},
+		{{"HUGE", long(3 * maxWrite)}},
+	}
+
+	for _, pairs := range tests {
+		c := &bufConn{}
+		if err := newConn(c).writePairs(typeParams, 1, pairs); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		body := readStream(t, c, typeParams)
+
+		got, err := parseParams(body)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+
+		if len(got) != len(pairs) || len(got) != 0 && !reflect.DeepEqual(got, pairs) {
+			t.Errorf("round trip of %d pairs (%d bytes) differs", len(pairs), len(body))
+		}
+	}
+}
+
+func TestParsePairs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		pairs map[string]string
+	}{
+		{
+			name:  "short lengths",
+			input: []byte("\x01\x02AB1"),
+			pairs: map[string]string{"A": "B1"},
+		},
+		{
+			name:  "long value",
+			input: append([]byte("\x01\x80\x00\x00\x80N"), strings.Repeat("v", 128)...),
+			pairs: map[string]string{"N": strings.Repeat("v", 128)},
+		},
+		{
+			name:  "long length of short value",
+			input: []byte("\x01\x80\x00\x00\x01NV"),
+			pairs: map[string]string{"N": "V"},
+		},
+		{
+			name:  "duplicate name",
+			input: []byte("\x01\x01AB\x01\x01AC"),
+			pairs: map[string]string{"A": "C"},
+		},
+		{
+			name:  "truncated value length",
+			input: []byte("\x01"),
+		},
+		{
+			name:  "truncated long length",
+			input: []byte("\x01\x80\x00"),
+		},
+		{
+			name:  "truncated name",
+			input: []byte("\x05\x00AB"),
+		},
+		{
+			name:  "truncated value",
+			input: []byte("\x01\x05AB"),
+		},
+		{
+			name:  "length over the body",
+			input: []byte("\x01\xff\xff\xff\xffAB"),
+		},
+		{
+			name:  "lengths overflowing together",
+			input: []byte("\xff\xff\xff\xff\xff\xff\xff\xffAB"),
+		},
+	}
+
+	for _, test := range tests {
+		pairs, err := parsePairs(test.input)
+
+		if test.pairs == nil {
+			if err != errMalformedPairs {
+				t.Errorf("%s: error = %v, want malformed", test.name, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(pairs, test.pairs) {
+			t.Errorf("%s: got %q", test.name, pairs)
+		}
+	}
+}
+
+func TestRecTypeString(t *testing.T) {
+	for recType := recType(0); recType < 20; recType++ {
+		want := "FCGI_UNKNOWN_TYPE"
+		if recType >= typeBeginRequest && recType < typeUnknownType {
+			want = recType.String()
+			if want == "FCGI_UNKNOWN_TYPE" {
+				t.Errorf("type %d has no name", recType)
+			}
+		}
+
+		if recType.String() != want {
+			t.Errorf("type %d = %s, want %s", recType, recType.String(), want)
+		}
+	}
+}
+
+//serveRaw serves single connection by the responder and returns the web server side of it.
+func serveRaw(t *testing.T) net.Conn {
+	t.Helper()
+
+	client, server := net.Pipe()
+
+	sc := &serverConn{
+		srv:  &Server{MaxConns: 10, Multiplex: true},
+		conn: newConn(server),
+		reqs: make(map[uint16]*serverRequest),
+	}
+
+	go sc.serve()
+
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return client
+}
+
+func TestUnknownTypeReply(t *testing.T) {
+	for _, recType := range []recType{0, typeBeginRequest, typeStdin, typeGetValuesResult, typeUnknownType, 42, 255} {
+		c := serveRaw(t)
+
+		go func() {
+			_, _ = c.Write(rawRecord(1, recType, 0, []byte("ignored"), 1))
+		}()
+
+		var rec serviceRecord
+		if err := rec.read(c); err != nil {
+			t.Fatalf("%d: %v", recType, err)
+		}
+
+		if rec.h.Type != typeUnknownType || rec.h.ID != 0 {
+			t.Fatalf("%d: got %v for request %d", recType, rec.h.Type, rec.h.ID)
+		}
+
+		want := [8]byte{byte(recType)}
+		if !bytes.Equal(rec.body(), want[:]) {
+			t.Fatalf("%d: body = %x, want %x", recType, rec.body(), want)
+		}
+	}
+}
+
+func TestGetValuesReply(t *testing.T) {
+	c := serveRaw(t)
+
+	values, err := queryValues(context.Background(), c, ValueMaxConns, ValueMpxsConns, "UNKNOWN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{ValueMaxConns: "10", ValueMpxsConns: "1"}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("values = %q, want %q", values, want)
+	}
+}
+
+func TestGetValuesUnknownType(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	//backend which does not know FCGI_GET_VALUES
+	go func() {
+		var rec serviceRecord
+		if err := rec.read(server); err != nil {
+			return
+		}
+
+		_, _ = server.Write(rawRecord(1, typeUnknownType, 0, []byte{byte(rec.h.Type), 0, 0, 0, 0, 0, 0, 0}, 0))
+	}()
+
+	if _, err := queryValues(context.Background(), client, ValueMaxConns); err == nil {
+		t.Fatal("FCGI_UNKNOWN_TYPE reply accepted as values")
+	}
+}
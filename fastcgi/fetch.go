@@ -0,0 +1,58 @@
+package fastcgi
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+)
+
+//Fetch sends GET request of the URI to the backend and returns status and body of the response,
+//e.g. of php-fpm ping and status pages. Path of the URI is passed as the script name.
+func (c *Client) Fetch(ctx context.Context, uri string) (int, []byte, error) {
+	raw, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+uri, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req := NewRequest(raw)
+	req.SetParam("SCRIPT_NAME", raw.URL.Path)
+	req.SetParam("SCRIPT_FILENAME", raw.URL.Path)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	w := &bufferWriter{header: make(http.Header), status: http.StatusOK}
+	err = resp.WriteTo(w, ioutil.Discard)
+
+	if failure := resp.Err(); failure != nil {
+		return 0, nil, failure
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return w.status, w.body.Bytes(), nil
+}
+
+//bufferWriter keeps the response in memory.
+type bufferWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+}
+
+func (w *bufferWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
@@ -0,0 +1,45 @@
+package fastcgi
+
+import "errors"
+
+const (
+	//default limit of the single response header line
+	defaultMaxHeaderLine = 64 << 10
+
+	//default limit of the whole response header block, same as http.DefaultMaxHeaderBytes
+	defaultMaxHeaderSize = 1 << 20
+)
+
+var (
+	//ErrHeaderLineTooLong is returned by WriteTo when response header line exceeds the limit.
+	ErrHeaderLineTooLong = errors.New("gofast: response header line too long")
+
+	//ErrHeaderTooLarge is returned by WriteTo when response headers exceed the limit.
+	ErrHeaderTooLarge = errors.New("gofast: response headers too large")
+)
+
+//HeaderLimits limit response headers of the application, zero values fall back to defaults.
+//Responses exceeding the limits are answered with 502.
+type HeaderLimits struct {
+	//MaxLine limits single header line, defaults to 64KB.
+	MaxLine int
+
+	//MaxSize limits the whole header block, defaults to 1MB.
+	MaxSize int
+}
+
+func (l HeaderLimits) maxLine() int {
+	if l.MaxLine <= 0 {
+		return defaultMaxHeaderLine
+	}
+
+	return l.MaxLine
+}
+
+func (l HeaderLimits) maxSize() int {
+	if l.MaxSize <= 0 {
+		return defaultMaxHeaderSize
+	}
+
+	return l.MaxSize
+}
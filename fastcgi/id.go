@@ -1,5 +1,7 @@
 package fastcgi
 
+//idPool hands out request IDs unique within the connection. ID 0 is reserved for
+//management records and never allocated.
 type idPool struct {
 	ids chan uint16
 }
@@ -9,25 +11,18 @@ func (p *idPool) Alloc() uint16 {
 }
 
 func (p *idPool) Release(id uint16) {
-	go func() {
-		p.ids <- id
-	}()
+	p.ids <- id
 }
 
 func newIDs(limit uint32) (p idPool) {
-	if limit == 0 || limit > 65536 {
-		limit = 65536
+	if limit == 0 || limit > 65535 {
+		limit = 65535
 	}
 
-	ids := make(chan uint16)
-
-	go func(maxID uint16) {
-		for i := uint16(0); i < maxID; i++ {
-			ids <- i
-		}
-
-		ids <- maxID
-	}(uint16(limit - 1))
+	ids := make(chan uint16, limit)
+	for i := uint32(1); i <= limit; i++ {
+		ids <- uint16(i)
+	}
 
 	p.ids = ids
 
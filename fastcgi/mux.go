@@ -0,0 +1,335 @@
+package fastcgi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//output of the multiplexed request queued for its reader, the request is aborted once exceeded
+const streamBuffer = 256 * 1024
+
+var errConnClosed = errors.New("gofast: connection closed before end of request")
+
+//ErrStreamStalled is returned when the reader of the multiplexed request did not keep up with its
+//output, the request is aborted so it does not hold up other requests of the connection.
+var ErrStreamStalled = errors.New("gofast: response reader stalled")
+
+//stream delivers records of a single request into its response pipe.
+type stream struct {
+	resp  *ResponsePipe
+	ended chan struct{}
+
+	//set to 1 once the first record arrived
+	recv int32
+
+	//first record of unexpected type, such records are skipped
+	unexpected error
+
+	//set before ended is closed
+	err  error
+	once sync.Once
+
+	//output of the multiplexed request waiting for the pump, see push
+	mu      sync.Mutex
+	queue   []queuedRecord
+	queued  int
+	stalled bool
+	ready   chan struct{}
+
+	//abort of the stalled request is written before the stream ends so its ID is not reused first
+	aborting sync.WaitGroup
+}
+
+//queuedRecord is record of the multiplexed request waiting for delivery, last one ends the stream.
+type queuedRecord struct {
+	typ  recType
+	body []byte
+	end  *EndRequest
+	last bool
+	err  error
+}
+
+func newStream(resp *ResponsePipe) *stream {
+	return &stream{
+		resp:  resp,
+		ended: make(chan struct{}),
+	}
+}
+
+//handle processes record addressed to the request, returns true once request is complete.
+func (s *stream) handle(rec *serviceRecord) (bool, error) {
+	if rec.h.Type != typeEndRequest {
+		s.deliver(rec.h.Type, rec.body())
+		return false, nil
+	}
+
+	end, err := readEndRequest(rec.body())
+	if err != nil {
+		return true, err
+	}
+
+	s.resp.setEndRequest(end)
+
+	return true, nil
+}
+
+//deliver writes output of the request into its pipes, it blocks until the output is read.
+func (s *stream) deliver(typ recType, b []byte) {
+	switch typ {
+		//empty records only close the streams, pipes are closed once the request is complete
+		case typeStdout:
+			if len(b) != 0 {
+				s.resp.outputStarted()
+				s.resp.stdOutWriter.Write(b)
+			}
+
+		case typeStderr:
+			if len(b) != 0 {
+				s.resp.outputStarted()
+				s.resp.stdErrWriter.Write(b)
+			}
+
+		default:
+			if s.unexpected == nil {
+				s.unexpected = fmt.Errorf("gofast: unexpected record type %v", typ)
+			}
+	}
+}
+
+//received reports whether backend started to respond.
+func (s *stream) received() bool {
+	return atomic.LoadInt32(&s.recv) == 1
+}
+
+//read reads records from the connection which is not shared with other requests, records after
+//the first one must arrive within idle timeout of the previous one being delivered unless it is zero.
+func (s *stream) read(c *conn, nc net.Conn, reqID uint16, idle time.Duration) {
+	var rec serviceRecord
+
+	for {
+		if err := c.readRecord(&rec); err != nil {
+			switch {
+				case err == io.EOF:
+					err = errConnClosed
+
+				case isTimeout(err) && s.received():
+					err = ErrReadIdleTimeout
+
+				case isTimeout(err):
+					err = ErrFirstByteTimeout
+			}
+
+			s.end(err)
+			return
+		}
+
+		first := atomic.SwapInt32(&s.recv, 1) == 0
+
+		if rec.h.ID != reqID {
+			s.end(fmt.Errorf("gofast: unexpected request ID %d, expected %d", rec.h.ID, reqID))
+			return
+		}
+
+		if done, err := s.handle(&rec); done {
+			s.end(err)
+			return
+		}
+
+		//first byte deadline no longer applies once the backend responded, idle time starts once
+		//the record has been delivered so slow client does not use it up
+		if idle > 0 {
+			_ = nc.SetReadDeadline(time.Now().Add(idle))
+		} else if first {
+			_ = nc.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
+//end marks stream as complete, err is set when connection failed before FCGI_END_REQUEST.
+func (s *stream) end(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.ended)
+	})
+}
+
+//push queues record of the multiplexed request for the pump, it never blocks the demux. Output
+//exceeding streamBuffer stalls the stream, its pipes fail and the rest of its output is dropped;
+//true is returned when the stream stalled by this record.
+func (s *stream) push(qr queuedRecord) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+		case qr.last:
+
+		case s.stalled:
+			return false
+
+		case s.queued+len(qr.body) > streamBuffer:
+			s.stalled, s.queue = true, nil
+
+			//unblock the pump, nobody reads the response anymore
+			s.resp.closeWithError(ErrStreamStalled)
+			_ = s.resp.stdErrWriter.Close()
+
+			return true
+	}
+
+	s.queue = append(s.queue, qr)
+	s.queued += len(qr.body)
+
+	select {
+		case s.ready <- struct{}{}:
+		default:
+	}
+
+	return false
+}
+
+//pump delivers queued records of the multiplexed request until the last one.
+func (s *stream) pump() {
+	for {
+		<-s.ready
+
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		for _, qr := range queue {
+			if !qr.last {
+				s.deliver(qr.typ, qr.body)
+
+				s.mu.Lock()
+				s.queued -= len(qr.body)
+				s.mu.Unlock()
+
+				continue
+			}
+
+			if qr.end != nil {
+				s.resp.setEndRequest(qr.end)
+			}
+
+			s.mu.Lock()
+			err := qr.err
+			if err == nil && s.stalled {
+				err = ErrStreamStalled
+			}
+			s.mu.Unlock()
+
+			s.aborting.Wait()
+			s.end(err)
+			return
+		}
+	}
+}
+
+//demux reads records from multiplexed connection and routes them to requests by ID.
+type demux struct {
+	mu      sync.Mutex
+	streams map[uint16]*stream
+	err     error
+}
+
+func newDemux() *demux {
+	return &demux{
+		streams: make(map[uint16]*stream),
+	}
+}
+
+//register starts routing records with given ID to the stream.
+func (m *demux) register(reqID uint16, s *stream) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	s.ready = make(chan struct{}, 1)
+	m.streams[reqID] = s
+	go s.pump()
+
+	return nil
+}
+
+//failed returns error which broke the connection, if any.
+func (m *demux) failed() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+//serve reads connection until it fails. Streams stay registered until the backend ends them, so
+//record of the unknown request breaks the connection. Records are queued for the streams so slow
+//reader of one request does not hold up the others.
+func (m *demux) serve(c *conn) {
+	var rec serviceRecord
+
+	for {
+		if err := c.readRecord(&rec); err != nil {
+			if err == io.EOF {
+				err = errConnClosed
+			}
+
+			m.fail(err)
+			return
+		}
+
+		m.mu.Lock()
+		s := m.streams[rec.h.ID]
+		m.mu.Unlock()
+
+		if s == nil {
+			m.fail(fmt.Errorf("gofast: unexpected request ID %d", rec.h.ID))
+			return
+		}
+
+		if rec.h.Type != typeEndRequest {
+			//stalled request is aborted, its ID stays in use until the backend ends it
+			body := append([]byte(nil), rec.body()...)
+			if s.push(queuedRecord{typ: rec.h.Type, body: body}) {
+				s.aborting.Add(1)
+				go func(reqID uint16) {
+					_ = c.writeAbortRequest(reqID)
+					s.aborting.Done()
+				}(rec.h.ID)
+			}
+
+			continue
+		}
+
+		end, err := readEndRequest(rec.body())
+		if err != nil {
+			//framing can not be trusted anymore
+			m.fail(err)
+			return
+		}
+
+		m.mu.Lock()
+		delete(m.streams, rec.h.ID)
+		m.mu.Unlock()
+
+		s.push(queuedRecord{end: end, last: true})
+	}
+}
+
+//fail ends all registered streams with given error.
+func (m *demux) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.err = err
+	for id, s := range m.streams {
+		delete(m.streams, id)
+		s.push(queuedRecord{last: true, err: err})
+	}
+}
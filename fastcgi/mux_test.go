@@ -0,0 +1,247 @@
+package fastcgi
+
+import (
+	"bytes"
+	"context"
+	"fast-php/fastcgi/fastcgitest"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testMuxClient creates client multiplexing requests over connections to the fake backend, dialed
+//connections are returned by the conns func.
+func testMuxClient(t *testing.T, cfg PoolConfig, h fastcgitest.Handler) (*Client, func() []net.Conn) {
+	srv := fastcgitest.NewPipeServer(h)
+	srv.Values = map[string]string{ValueMpxsConns: "1"}
+	t.Cleanup(srv.Close)
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	dial := func(ctx context.Context) (net.Conn, error) {
+		nc, err := srv.Dial(ctx)
+		if err == nil {
+			mu.Lock()
+			conns = append(conns, nc)
+			mu.Unlock()
+		}
+
+		return nc, err
+	}
+
+	cfg.Multiplex = true
+	c := NewClient(dial, cfg)
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+
+	return c, func() []net.Conn {
+		mu.Lock()
+		defer mu.Unlock()
+
+		//first connection only answered FCGI_GET_VALUES
+		return append([]net.Conn(nil), conns[1:]...)
+	}
+}
+
+//echoHandler responds with the path of the request after given delay.
+func echoHandler(delay time.Duration) fastcgitest.Handler {
+	return func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{
+			Status: 200,
+			Header: http.Header{"Content-Type": {"text/plain"}},
+			Stdout: [][]byte{[]byte(req.Params["REQUEST_URI"])},
+			Delay:  delay,
+		}
+	}
+}
+
+//get sends request and returns its body along with the client failure.
+func get(c *Client, uri string) (string, error) {
+	resp, err := c.Do(NewRequest(httptest.NewRequest("GET", uri, nil)))
+	if err != nil {
+		return "", err
+	}
+
+	rec := httptest.NewRecorder()
+	_ = resp.WriteTo(rec, ioutil.Discard)
+
+	return rec.Body.String(), resp.Err()
+}
+
+func TestMuxConcurrentRequests(t *testing.T) {
+	c, conns := testMuxClient(t, PoolConfig{}, echoHandler(50*time.Millisecond))
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 8)
+	errs := make([]error, 8)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i], errs[i] = get(c, "/"+string(rune('a'+i)))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range bodies {
+		if errs[i] != nil || bodies[i] != "/"+string(rune('a'+i)) {
+			t.Fatalf("request %d: body %q, error %v", i, bodies[i], errs[i])
+		}
+	}
+
+	if n := len(conns()); n != 1 {
+		t.Fatalf("%d connections opened, requests were expected to share one", n)
+	}
+}
+
+func TestMuxIDReuse(t *testing.T) {
+	var mu sync.Mutex
+	ids := make(map[uint16]int)
+	echo := echoHandler(10 * time.Millisecond)
+
+	c, conns := testMuxClient(t, PoolConfig{MaxRequests: 2}, func(req *fastcgitest.Request) *fastcgitest.Response {
+		mu.Lock()
+		ids[req.ID]++
+		mu.Unlock()
+
+		return echo(req)
+	})
+
+	//two requests at a time keep the connection busy so its IDs are released and taken again
+	for round := 0; round < 3; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if body, err := get(c, "/reuse"); err != nil || body != "/reuse" {
+					t.Errorf("body %q, error %v", body, err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	if len(ids) != 2 || ids[1] != 3 || ids[2] != 3 {
+		t.Fatalf("requests by ID %v, IDs 1 and 2 were expected to be used 3 times each", ids)
+	}
+
+	if n := len(conns()); n != 1 {
+		t.Fatalf("%d connections opened, expected 1", n)
+	}
+}
+
+func TestMuxFailureEndsAllStreams(t *testing.T) {
+	c, conns := testMuxClient(t, PoolConfig{}, func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{Status: 200, Stdout: [][]byte{[]byte("partial")}, Fault: fastcgitest.FaultHang}
+	})
+
+	var resps []*ResponsePipe
+	for i := 0; i < 3; i++ {
+		resp, err := c.Do(NewRequest(httptest.NewRequest("GET", "/", nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resps = append(resps, resp)
+	}
+
+	for _, resp := range resps {
+		<-resp.output
+	}
+
+	_ = conns()[0].Close()
+
+	for i, resp := range resps {
+		go resp.WriteTo(httptest.NewRecorder(), ioutil.Discard)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- resp.Err()
+		}()
+
+		select {
+			case err := <-done:
+				if err == nil {
+					t.Fatalf("request %d succeeded over broken connection", i)
+				}
+
+			case <-time.After(2 * time.Second):
+				t.Fatalf("request %d did not end once connection failed", i)
+		}
+	}
+}
+
+func TestMuxDeadConnectionIsReplaced(t *testing.T) {
+	c, conns := testMuxClient(t, PoolConfig{}, echoHandler(0))
+
+	if body, err := get(c, "/first"); err != nil || body != "/first" {
+		t.Fatalf("body %q, error %v", body, err)
+	}
+
+	//idle connection dies, demux notices it before the next request is sent
+	_ = conns()[0].Close()
+	time.Sleep(20 * time.Millisecond)
+
+	if body, err := get(c, "/second"); err != nil || body != "/second" {
+		t.Fatalf("body %q, error %v", body, err)
+	}
+
+	if n := len(conns()); n != 2 {
+		t.Fatalf("%d connections opened, expected the dead one to be replaced", n)
+	}
+}
+
+func TestMuxStalledStream(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 2*streamBuffer)
+
+	c, conns := testMuxClient(t, PoolConfig{}, func(req *fastcgitest.Request) *fastcgitest.Response {
+		if req.Params["REQUEST_URI"] == "/big" {
+			return &fastcgitest.Response{Status: 200, Stdout: [][]byte{big}}
+		}
+
+		return echoHandler(0)(req)
+	})
+
+	//nobody reads the big response
+	stalled, err := c.Do(NewRequest(httptest.NewRequest("GET", "/big", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if body, err := get(c, "/small"); err != nil || body != "/small" {
+			t.Errorf("body %q, error %v", body, err)
+		}
+	}()
+
+	select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("request was held up by the stalled one")
+	}
+
+	if err := stalled.Err(); err != ErrStreamStalled {
+		t.Fatalf("stalled request failed with %v, expected %v", err, ErrStreamStalled)
+	}
+
+	if _, err := ioutil.ReadAll(stalled.stdOutReader); err != ErrStreamStalled {
+		t.Fatalf("reader of the stalled response got %v, expected %v", err, ErrStreamStalled)
+	}
+
+	//connection is kept as the backend ended the stalled request
+	if body, err := get(c, "/after"); err != nil || body != "/after" {
+		t.Fatalf("body %q, error %v", body, err)
+	}
+
+	if n := len(conns()); n != 1 {
+		t.Fatalf("%d connections opened, expected 1", n)
+	}
+}
@@ -0,0 +1,173 @@
+package fastcgi
+
+import (
+	"sort"
+	"strings"
+)
+
+//Param is single name-value pair of FCGI_PARAMS.
+type Param struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+//Params are name-value pairs in order they are sent to the backend, names may repeat.
+type Params []Param
+
+//Get returns the first value of the name, empty when there is none.
+func (p Params) Get(name string) string {
+	for _, param := range p {
+		if param.Name == name {
+			return param.Value
+		}
+	}
+
+	return ""
+}
+
+//Values returns all values of the name in order.
+func (p Params) Values(name string) []string {
+	var values []string
+	for _, param := range p {
+		if param.Name == name {
+			values = append(values, param.Value)
+		}
+	}
+
+	return values
+}
+
+//Add appends the pair, existing values of the name are kept.
+func (p *Params) Add(name string, value string) {
+	*p = append(*p, Param{Name: name, Value: value})
+}
+
+//Set replaces the first value of the name and removes the others, pair is appended when the name
+//is not present.
+func (p *Params) Set(name string, value string) {
+	params, set := (*p)[:0], false
+	for _, param := range *p {
+		if param.Name != name {
+			params = append(params, param)
+			continue
+		}
+
+		if !set {
+			params, set = append(params, Param{Name: name, Value: value}), true
+		}
+	}
+
+	if !set {
+		params = append(params, Param{Name: name, Value: value})
+	}
+
+	*p = params
+}
+
+//Del removes all values of the name.
+func (p *Params) Del(name string) {
+	params := (*p)[:0]
+	for _, param := range *p {
+		if param.Name != name {
+			params = append(params, param)
+		}
+	}
+
+	*p = params
+}
+
+//Map folds the params into map, values of repeated names are joined as the http headers are.
+func (p Params) Map() map[string]string {
+	m := make(map[string]string, len(p))
+	for _, param := range p {
+		if value, ok := m[param.Name]; ok {
+			m[param.Name] = foldParam(param.Name, value, param.Value)
+			continue
+		}
+
+		m[param.Name] = param.Value
+	}
+
+	return m
+}
+
+//foldParam joins values of the repeated name, cookies are separated by semicolon (RFC 6265, 5.4).
+func foldParam(name string, values ...string) string {
+	if name == "HTTP_COOKIE" {
+		return strings.Join(values, "; ")
+	}
+
+	return strings.Join(values, ", ")
+}
+
+//Param returns value of the param, repeated values are folded.
+func (req *Request) Param(name string) string {
+	return req.Params[name]
+}
+
+//SetParam sets the param replacing all its values.
+func (req *Request) SetParam(name string, value string) {
+	if req.Params == nil {
+		req.Params = make(map[string]string)
+	}
+
+	req.pairs.Set(name, value)
+	req.Params[name] = value
+}
+
+//AddParam appends another value of the param, values are sent as separate pairs.
+func (req *Request) AddParam(name string, value string) {
+	if req.Params == nil {
+		req.Params = make(map[string]string)
+	}
+
+	if prev, ok := req.Params[name]; ok {
+		req.Params[name] = foldParam(name, prev, value)
+	} else {
+		req.Params[name] = value
+	}
+
+	req.pairs.Add(name, value)
+}
+
+//DelParam removes all values of the param.
+func (req *Request) DelParam(name string) {
+	req.pairs.Del(name)
+	delete(req.Params, name)
+}
+
+//Pairs returns params in order they are sent. Params map is kept for the options written before
+//the params were ordered: pairs changed or removed through the map are replaced by the map value
+//or left out, pairs only present in the map follow sorted by name.
+func (req *Request) Pairs() Params {
+	pairs := make(Params, 0, len(req.Params))
+	folded, replaced := req.pairs.Map(), make(map[string]bool)
+
+	for _, pair := range req.pairs {
+		value, ok := req.Params[pair.Name]
+		switch {
+			case !ok, replaced[pair.Name]:
+				continue
+
+			case value != folded[pair.Name]:
+				pairs, replaced[pair.Name] = append(pairs, Param{Name: pair.Name, Value: value}), true
+				continue
+		}
+
+		pairs = append(pairs, pair)
+	}
+
+	var names []string
+	for name := range req.Params {
+		if _, ok := folded[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		pairs = append(pairs, Param{Name: name, Value: req.Params[name]})
+	}
+
+	return pairs
+}
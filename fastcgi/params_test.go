@@ -0,0 +1,123 @@
+package fastcgi
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParams(t *testing.T) {
+	var p Params
+	p.Add("A", "1")
+	p.Add("B", "2")
+	p.Add("A", "3")
+
+	if p.Get("A") != "1" || !reflect.DeepEqual(p.Values("A"), []string{"1", "3"}) || p.Get("C") != "" {
+		t.Fatalf("params = %v", p)
+	}
+
+	if m := p.Map(); !reflect.DeepEqual(m, map[string]string{"A": "1, 3", "B": "2"}) {
+		t.Fatalf("map = %v", m)
+	}
+
+	p.Set("A", "4")
+	p.Set("C", "5")
+	if want := (Params{{"A", "4"}, {"B", "2"}, {"C", "5"}}); !reflect.DeepEqual(p, want) {
+		t.Fatalf("params = %v, want %v", p, want)
+	}
+
+	p.Del("B")
+	if want := (Params{{"A", "4"}, {"C", "5"}}); !reflect.DeepEqual(p, want) {
+		t.Fatalf("params = %v, want %v", p, want)
+	}
+}
+
+func TestRequestEncodingIsDeterministic(t *testing.T) {
+	encode := func() []byte {
+		r := httptest.NewRequest("GET", "/index.php/info?a=1", nil)
+		for _, name := range []string{"X-A", "X-B", "X-C", "X-D", "X-E", "X-F", "X-G", "X-H"} {
+			r.Header.Set(name, name)
+		}
+
+		req := NewRequest(r, OptionScript(&ScriptConfig{DocumentRoot: "/app"}))
+
+		c := &bufConn{}
+		if err := newConn(c).writePairs(typeParams, 1, req.Pairs()); err != nil {
+			t.Fatal(err)
+		}
+
+		return c.Bytes()
+	}
+
+	first := encode()
+	for i := 0; i < 20; i++ {
+		if !bytes.Equal(encode(), first) {
+			t.Fatal("params encoded differently")
+		}
+	}
+}
+
+func TestRequestHeaderFolding(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Add("Accept", "text/html")
+	r.Header.Add("Accept", "application/json")
+	r.Header.Add("Cookie", "a=1")
+	r.Header.Add("Cookie", "b=2")
+
+	req := NewRequest(r)
+	pairs := req.Pairs()
+
+	if values := pairs.Values("HTTP_ACCEPT"); !reflect.DeepEqual(values, []string{"text/html, application/json"}) {
+		t.Errorf("HTTP_ACCEPT = %q", values)
+	}
+
+	if values := pairs.Values("HTTP_COOKIE"); !reflect.DeepEqual(values, []string{"a=1; b=2"}) {
+		t.Errorf("HTTP_COOKIE = %q", values)
+	}
+
+	if req.Param("HTTP_COOKIE") != "a=1; b=2" {
+		t.Errorf("folded HTTP_COOKIE = %q", req.Param("HTTP_COOKIE"))
+	}
+}
+
+func TestRequestPairs(t *testing.T) {
+	req := NewRequest(httptest.NewRequest("GET", "/", nil))
+	req.pairs = nil
+	req.Params = map[string]string{}
+
+	req.SetParam("A", "1")
+	req.AddParam("B", "2")
+	req.AddParam("B", "3")
+	req.SetParam("C", "4")
+	req.SetParam("D", "5")
+
+	//options written against the map
+	req.Params["C"] = "changed"
+	delete(req.Params, "D")
+	req.Params["Z"] = "z"
+	req.Params["Y"] = "y"
+
+	want := Params{{"A", "1"}, {"B", "2"}, {"B", "3"}, {"C", "changed"}, {"Y", "y"}, {"Z", "z"}}
+	if pairs := req.Pairs(); !reflect.DeepEqual(pairs, want) {
+		t.Fatalf("pairs = %v, want %v", pairs, want)
+	}
+
+	if req.Param("B") != "2, 3" {
+		t.Fatalf("B = %q", req.Param("B"))
+	}
+
+	//replacing folded value through the map sends it once
+	req.Params["B"] = "4"
+	if values := req.Pairs().Values("B"); !reflect.DeepEqual(values, []string{"4"}) {
+		t.Fatalf("B = %q", values)
+	}
+}
+
+func TestRequestPairsOfMapOnlyRequest(t *testing.T) {
+	req := &Request{Params: map[string]string{"B": "2", "A": "1"}}
+
+	if pairs, want := req.Pairs(), (Params{{"A", "1"}, {"B", "2"}}); !reflect.DeepEqual(pairs, want) {
+		t.Fatalf("pairs = %v, want %v", pairs, want)
+	}
+}
@@ -0,0 +1,453 @@
+package fastcgi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	//default amount of idle connections kept by the pool
+	defaultMaxIdle = 2
+
+	//default amount of concurrent requests over multiplexed connection
+	defaultMaxRequests = 16
+
+	//how long to wait for backend to answer FCGI_GET_VALUES
+	probeTimeout = 2 * time.Second
+)
+
+var errPoolClosed = errors.New("gofast: connection pool has been closed")
+var errUnexpectedData = errors.New("gofast: unexpected data on idle connection")
+
+//aLongTimeAgo is used as read deadline to interrupt pending reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
+//PoolConfig configures connection pool of the client.
+type PoolConfig struct {
+	//MaxIdle defines how many idle connections are kept open, defaults to 2.
+	MaxIdle int
+
+	//MaxOpen limits amount of connections open at the same time, 0 means no limit or FCGI_MAX_CONNS
+	//of the backend when Discover is enabled.
+	MaxOpen int
+
+	//IdleTimeout closes connections which stayed idle longer than given duration, 0 keeps
+	//idle connections open forever.
+	IdleTimeout time.Duration
+
+	//Multiplex enables concurrent requests over the same connection, it only takes effect when
+	//backend reports FCGI_MPXS_CONNS=1. Multiplexed connections with no request in flight count
+	//as idle, they are limited by MaxIdle and closed after IdleTimeout like the others.
+	Multiplex bool
+
+	//MaxRequests limits concurrent requests over single multiplexed connection, defaults to
+	//FCGI_MAX_REQS of the backend when Discover is enabled and to 16 otherwise.
+	MaxRequests int
+
+	//Discover queries backend capabilities before opening the first connection so limits left
+	//empty follow the backend configuration.
+	Discover bool
+}
+
+//poolConn is backend connection managed by the pool.
+type poolConn struct {
+	*conn
+	netConn net.Conn
+	ids     idPool
+
+	//routes records to requests, nil unless connection is multiplexed
+	mux *demux
+
+	//guarded by pool mutex, retired connection takes no new requests and is closed once
+	//requests in flight are done
+	inflight int
+	usedAt   time.Time
+	retired  bool
+
+	//result of the idle read, see watch
+	watching chan error
+}
+
+//watch starts reading from the idle connection, backend is not supposed to send anything
+//until the next request so any read result means connection is no longer usable.
+func (pc *poolConn) watch() {
+	pc.watching = make(chan error, 1)
+
+	go func() {
+		var b [1]byte
+		_, err := pc.netConn.Read(b[:])
+		if err == nil {
+			err = errUnexpectedData
+		}
+
+		pc.watching <- err
+	}()
+}
+
+//alive reports whether connection can take the request, idle read is interrupted for
+//connections which are not multiplexed.
+func (pc *poolConn) alive() bool {
+	if pc.mux != nil {
+		return pc.mux.failed() == nil
+	}
+
+	if pc.watching == nil {
+		return true
+	}
+
+	_ = pc.netConn.SetReadDeadline(aLongTimeAgo)
+	err := <-pc.watching
+	pc.watching = nil
+
+	if !isTimeout(err) {
+		return false
+	}
+
+	return pc.netConn.SetReadDeadline(time.Time{}) == nil
+}
+
+//pool keeps connections to a single backend and hands them to requests, connections are
+//shared between requests only when backend supports multiplexing.
+type pool struct {
+	dial Dialer
+	cfg  PoolConfig
+
+	mu      sync.Mutex
+	conns   []*poolConn
+	dialing int
+	wake    chan struct{}
+	stop    chan struct{}
+	closed  bool
+
+	//effective limits, known once backend has been probed
+	probeMu sync.Mutex
+	probed  bool
+	maxOpen int
+	reqs    uint32
+}
+
+func newPool(dial Dialer, cfg PoolConfig) *pool {
+	if cfg.MaxIdle == 0 {
+		cfg.MaxIdle = defaultMaxIdle
+	}
+
+	p := &pool{
+		dial:    dial,
+		cfg:     cfg,
+		conns:   make([]*poolConn, 0),
+		wake:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		probed:  !cfg.Multiplex && !cfg.Discover,
+		maxOpen: cfg.MaxOpen,
+		reqs:    1,
+	}
+
+	if cfg.IdleTimeout > 0 {
+		go p.clean()
+	}
+
+	return p
+}
+
+//get returns healthy connection, opens new one or waits until one is released.
+func (p *pool) get(ctx context.Context) (*poolConn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errPoolClosed
+		}
+
+		if !p.probed {
+			p.mu.Unlock()
+
+			if err := p.probe(ctx); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if pc := p.take(); pc != nil {
+			p.mu.Unlock()
+
+			if pc.alive() {
+				return pc, nil
+			}
+
+			p.put(pc, false)
+			continue
+		}
+
+		if p.maxOpen <= 0 || len(p.conns)+p.dialing < p.maxOpen {
+			p.dialing++
+			p.mu.Unlock()
+
+			return p.open(ctx)
+		}
+
+		wake := p.wake
+		p.mu.Unlock()
+
+		select {
+			case <-wake:
+				//try again
+			case <-ctx.Done():
+				return nil, ctx.Err()
+		}
+	}
+}
+
+//open dials new connection and registers it in the pool.
+func (p *pool) open(ctx context.Context) (*poolConn, error) {
+	nc, err := p.dial(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+
+	if err == nil && p.closed {
+		_ = nc.Close()
+		err = errPoolClosed
+	}
+
+	if err != nil {
+		p.notify()
+		return nil, err
+	}
+
+	pc := &poolConn{
+		conn:     newConn(nc),
+		netConn:  nc,
+		ids:      newIDs(p.reqs),
+		inflight: 1,
+	}
+
+	if p.reqs > 1 {
+		pc.mux = newDemux()
+		go pc.mux.serve(pc.conn)
+	}
+
+	p.conns = append(p.conns, pc)
+
+	return pc, nil
+}
+
+//put returns request slot to the pool, connection is dropped when it can not be reused or too
+//many idle connections are open already.
+func (p *pool) put(pc *poolConn, reuse bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc.inflight--
+	pc.usedAt = time.Now()
+
+	if !reuse || p.closed {
+		pc.retired = true
+	}
+
+	switch {
+		case pc.retired:
+			p.retire(pc)
+
+		case pc.inflight > 0:
+			//still in use by other requests
+
+		case p.numIdle() > p.cfg.MaxIdle:
+			p.remove(pc)
+
+		case pc.mux == nil:
+			pc.watch()
+	}
+
+	p.notify()
+}
+
+//take reserves request slot on the open connection. Busy multiplexed connections are preferred
+//over idle ones to keep amount of open connections low, expired connections are closed on the way.
+func (p *pool) take() *poolConn {
+	var idle *poolConn
+	now := time.Now()
+
+	for i := len(p.conns) - 1; i >= 0; i-- {
+		pc := p.conns[i]
+
+		if pc.inflight == 0 {
+			if p.expired(pc, now) {
+				p.remove(pc)
+				continue
+			}
+
+			if idle == nil {
+				idle = pc
+			}
+
+			continue
+		}
+
+		if pc.mux != nil && uint32(pc.inflight) < p.reqs && pc.mux.failed() == nil {
+			pc.inflight++
+			return pc
+		}
+	}
+
+	if idle != nil {
+		idle.inflight++
+	}
+
+	return idle
+}
+
+//probe queries backend capabilities and sizes the pool accordingly, answer is kept for the pool
+//lifetime. Backends failing to answer are treated as not multiplexing and limits stay as configured.
+func (p *pool) probe(ctx context.Context) error {
+	p.probeMu.Lock()
+	defer p.probeMu.Unlock()
+
+	p.mu.Lock()
+	probed := p.probed
+	p.mu.Unlock()
+
+	if probed {
+		return nil
+	}
+
+	nc, err := p.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	caps := &Capabilities{}
+	if values, err := queryValues(ctx, nc, ValueMaxConns, ValueMaxReqs, ValueMpxsConns); err == nil {
+		caps = newCapabilities(values)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.probed = true
+	p.size(caps)
+
+	return nil
+}
+
+//size applies backend capabilities to the limits which were not configured explicitly.
+func (p *pool) size(caps *Capabilities) {
+	if p.cfg.Discover && p.cfg.MaxOpen == 0 {
+		p.maxOpen = int(caps.MaxConns)
+	}
+
+	if !p.cfg.Multiplex || !caps.MpxsConns {
+		return
+	}
+
+	switch {
+		case p.cfg.MaxRequests != 0:
+			p.reqs = uint32(p.cfg.MaxRequests)
+
+		case p.cfg.Discover && caps.MaxReqs != 0:
+			p.reqs = caps.MaxReqs
+
+		default:
+			p.reqs = defaultMaxRequests
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+
+	return ok && ne.Timeout()
+}
+
+func (p *pool) expired(pc *poolConn, now time.Time) bool {
+	return p.cfg.IdleTimeout > 0 && now.Sub(pc.usedAt) > p.cfg.IdleTimeout
+}
+
+func (p *pool) numIdle() (n int) {
+	for _, pc := range p.conns {
+		if pc.inflight == 0 {
+			n++
+		}
+	}
+
+	return
+}
+
+//remove closes connection and forgets about it, must be called under lock.
+func (p *pool) remove(pc *poolConn) {
+	p.forget(pc)
+	_ = pc.Close()
+}
+
+//retire forgets about the connection, it is closed once other requests are done with it. Must be
+//called under lock.
+func (p *pool) retire(pc *poolConn) {
+	p.forget(pc)
+
+	if pc.inflight == 0 {
+		_ = pc.Close()
+	}
+}
+
+func (p *pool) forget(pc *poolConn) {
+	for i, e := range p.conns {
+		if e == pc {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+//notify wakes up all requests waiting for the connection, must be called under lock.
+func (p *pool) notify() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+//clean periodically closes expired idle connections.
+func (p *pool) clean() {
+	ticker := time.NewTicker(p.cfg.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <-p.stop:
+				return
+
+			case now := <-ticker.C:
+				p.mu.Lock()
+				for i := len(p.conns) - 1; i >= 0; i-- {
+					if pc := p.conns[i]; pc.inflight == 0 && p.expired(pc, now) {
+						p.remove(pc)
+					}
+				}
+				p.mu.Unlock()
+		}
+	}
+}
+
+//close closes all idle connections, connections in use are closed once released.
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+
+	p.closed = true
+	close(p.stop)
+
+	for i := len(p.conns) - 1; i >= 0; i-- {
+		if pc := p.conns[i]; pc.inflight == 0 {
+			p.remove(pc)
+		}
+	}
+
+	p.notify()
+
+	return nil
+}
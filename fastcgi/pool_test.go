@@ -0,0 +1,268 @@
+package fastcgi
+
+import (
+	"context"
+	"fast-php/fastcgi/fastcgitest"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//openConns returns amount of connections kept by the pool.
+func openConns(p *pool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.conns)
+}
+
+//getAll sends n concurrent requests and waits for them.
+func getAll(t *testing.T, c *Client, n int) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if body, err := get(c, "/pooled"); err != nil || body != "/pooled" {
+				t.Errorf("body %q, error %v", body, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestPoolReuse(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(echoHandler(0))
+	defer srv.Close()
+
+	var dialed int32
+	c := NewClient(countDials(srv, &dialed), PoolConfig{})
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		getAll(t, c, 1)
+	}
+
+	if n := atomic.LoadInt32(&dialed); n != 1 {
+		t.Fatalf("%d connections dialed for sequential requests", n)
+	}
+}
+
+func TestPoolMaxIdle(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(echoHandler(30 * time.Millisecond))
+	defer srv.Close()
+
+	var dialed int32
+	c := NewClient(countDials(srv, &dialed), PoolConfig{MaxIdle: 1})
+	defer c.Close()
+
+	getAll(t, c, 3)
+
+	if n := atomic.LoadInt32(&dialed); n != 3 {
+		t.Fatalf("%d connections dialed for concurrent requests", n)
+	}
+
+	if n := openConns(c.pool); n != 1 {
+		t.Fatalf("%d idle connections kept", n)
+	}
+}
+
+func TestPoolMaxOpen(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(echoHandler(30 * time.Millisecond))
+	defer srv.Close()
+
+	var dialed int32
+	c := NewClient(countDials(srv, &dialed), PoolConfig{MaxOpen: 1})
+	defer c.Close()
+
+	//requests wait for the only connection and are woken up once it is released
+	start := time.Now()
+	getAll(t, c, 3)
+
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("requests over single connection took %v", elapsed)
+	}
+
+	if n := atomic.LoadInt32(&dialed); n != 1 {
+		t.Fatalf("%d connections dialed", n)
+	}
+
+	//wait is bounded by the context of the request
+	pc, err := c.pool.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.pool.get(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("wait for busy pool returned %v", err)
+	}
+
+	c.pool.put(pc, true)
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(echoHandler(0))
+	defer srv.Close()
+
+	var dialed int32
+	c := NewClient(countDials(srv, &dialed), PoolConfig{IdleTimeout: 40 * time.Millisecond})
+	defer c.Close()
+
+	getAll(t, c, 1)
+
+	//cleaner runs every half of the timeout
+	time.Sleep(150 * time.Millisecond)
+
+	if n := openConns(c.pool); n != 0 {
+		t.Fatalf("%d expired connections kept", n)
+	}
+
+	getAll(t, c, 1)
+
+	if n := atomic.LoadInt32(&dialed); n != 2 {
+		t.Fatalf("%d connections dialed", n)
+	}
+}
+
+func TestPoolIdleConnectionClosedByBackend(t *testing.T) {
+	first := fastcgitest.NewPipeServer(echoHandler(0))
+	second := fastcgitest.NewPipeServer(echoHandler(0))
+	defer second.Close()
+
+	//connections go to the second server once the first one is gone
+	var dialed int32
+	dial := func(ctx context.Context) (net.Conn, error) {
+		if atomic.AddInt32(&dialed, 1) == 1 {
+			return first.Dial(ctx)
+		}
+
+		return second.Dial(ctx)
+	}
+
+	c := NewClient(dial, PoolConfig{})
+	defer c.Close()
+
+	getAll(t, c, 1)
+
+	//backend closes the idle connection, idle read notices it before the request is sent
+	first.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	resp, err := c.Do(NewRequest(httptest.NewRequest("GET", "/pooled", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := resp.WriteTo(rec, ioutil.Discard); err != nil || resp.Err() != nil || rec.Body.String() != "/pooled" {
+		t.Fatalf("request over closed connection: body %q, error %v %v", rec.Body.String(), err, resp.Err())
+	}
+
+	if n := atomic.LoadInt32(&dialed); n != 2 {
+		t.Fatalf("%d connections dialed", n)
+	}
+
+	if n := len(second.Requests()); n != 1 {
+		t.Fatalf("%d requests reached the second backend", n)
+	}
+}
+
+func TestPoolDiscover(t *testing.T) {
+	all := map[string]string{ValueMaxConns: "3", ValueMaxReqs: "5", ValueMpxsConns: "1"}
+
+	cases := []struct {
+		name    string
+		cfg     PoolConfig
+		values  map[string]string
+		silent  bool
+		maxOpen int
+		reqs    int
+	}{
+		{name: "discover", cfg: PoolConfig{Discover: true, Multiplex: true}, values: all, maxOpen: 3, reqs: 5},
+		{name: "discover without multiplexing", cfg: PoolConfig{Discover: true}, values: all, maxOpen: 3, reqs: 1},
+		{
+			name:    "backend does not multiplex",
+			cfg:     PoolConfig{Discover: true, Multiplex: true},
+			values:  map[string]string{ValueMaxConns: "3", ValueMaxReqs: "5", ValueMpxsConns: "0"},
+			maxOpen: 3,
+			reqs:    1,
+		},
+		{
+			name:    "configured limits",
+			cfg:     PoolConfig{Discover: true, Multiplex: true, MaxOpen: 2, MaxRequests: 4},
+			values:  all,
+			maxOpen: 2,
+			reqs:    4,
+		},
+		{name: "multiplex without discovery", cfg: PoolConfig{Multiplex: true}, values: all, reqs: defaultMaxRequests},
+		{name: "no answer", cfg: PoolConfig{Discover: true, Multiplex: true}, values: all, silent: true, reqs: 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := fastcgitest.NewPipeServer(echoHandler(0))
+			srv.Values = c.values
+			t.Cleanup(srv.Close)
+
+			//backend closes the connection instead of answering FCGI_GET_VALUES
+			var dialed int32
+			dial := func(ctx context.Context) (net.Conn, error) {
+				if atomic.AddInt32(&dialed, 1) == 1 && c.silent {
+					client, server := net.Pipe()
+					_ = server.Close()
+
+					return client, nil
+				}
+
+				return srv.Dial(ctx)
+			}
+
+			client := NewClient(dial, c.cfg)
+			t.Cleanup(func() {
+				_ = client.Close()
+			})
+
+			if body, err := get(client, "/sized"); err != nil || body != "/sized" {
+				t.Fatalf("body %q, error %v", body, err)
+			}
+
+			p := client.pool
+			p.mu.Lock()
+			maxOpen, reqs := p.maxOpen, cap(p.conns[0].ids.ids)
+			p.mu.Unlock()
+
+			if maxOpen != c.maxOpen || reqs != c.reqs {
+				t.Fatalf("max open %d, requests per connection %d", maxOpen, reqs)
+			}
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(echoHandler(0))
+	srv.Values = map[string]string{ValueMaxConns: "3", ValueMaxReqs: "5", ValueMpxsConns: "1"}
+	defer srv.Close()
+
+	c := NewClient(srv.Dial, PoolConfig{})
+	defer c.Close()
+
+	caps, err := c.Capabilities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *caps != (Capabilities{MaxConns: 3, MaxReqs: 5, MpxsConns: true}) {
+		t.Fatalf("capabilities %+v", *caps)
+	}
+}
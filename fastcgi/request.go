@@ -2,45 +2,282 @@ package fastcgi
 
 import (
 	"io"
+	"net"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+//extension of the scripts, request path is split into SCRIPT_NAME and PATH_INFO right after it
+const scriptExt = ".php"
+
 type Request struct {
-	Raw      *http.Request
-	Role     uint16
-	Params   map[string]string
+	Raw  *http.Request
+	Role uint16
+
+	//Params are the params folded into map, see Pairs for the params actually sent.
+	Params map[string]string
+
 	Stdin    io.ReadCloser
 	Data     io.ReadCloser
 	KeepConn uint8
+
+	//Sendfile enables X-Sendfile and X-Accel-Redirect, see OptionSendfile.
+	Sendfile *SendfileConfig
+
+	//LocalRedirects makes WriteTo report CGI local redirects, see OptionLocalRedirects.
+	LocalRedirects bool
+
+	//Trace dumps records of the request, see OptionTrace.
+	Trace *Tracer
+
+	//BodyBuffer reads stdin ahead, see OptionBodyBuffer.
+	BodyBuffer *BodyBuffer
+
+	//Mode controls how the response is passed to the client, see ResponseMode.
+	Mode ResponseMode
+
+	//ResponseBuffer configures buffered responses, see OptionBuffered.
+	ResponseBuffer *BodyBuffer
+
+	//buffered stdin, removed once the request is complete
+	body *spooledBody
+
+	//params in order they were set, see Pairs
+	pairs Params
 }
 
-type commonParams map[string]string
 type OptionRequest func(req *Request)
 
+//ScriptConfig maps requests onto the PHP scripts.
+type ScriptConfig struct {
+	//DocumentRoot is the directory scripts are located in, as seen by the backend.
+	DocumentRoot string
 
+	//FrontController is the script serving requests which do not point to .php file, e.g.
+	//index.php. Directory index is used when empty.
+	FrontController string
+}
+
+//NewRequest creates responder request with CGI/1.1 parameters derived from the http request,
+//use OptionScript to map request onto the script.
 func NewRequest(request *http.Request, reqConfig ...OptionRequest) *Request {
+	//if no http request, return here
+	if request == nil {
+		return nil
+	}
+
+	pairs := buildParams(request)
+
+	//pass body (io.ReadCloser) to stdio
 	req := &Request{
 		Raw:    request,
 		Role:   RoleResponder,
-		Params: make(map[string]string),
+		Params: pairs.Map(),
+		Stdin:  request.Body,
 		KeepConn: uint8(1),
-	}
-
-	//if no http request, return here
-	if request == nil {
-		return nil
+		pairs:  pairs,
 	}
 
 	for _, fn := range reqConfig {
 		fn(req)
 	}
 
-	//pass body (io.ReadCloser) to stdio
-	req.Stdin = request.Body
-
 	return req
 }
 
-func buildParams() commonParams {
-	params := make(commonParams)
+//OptionAuthorizer switches request to the authorizer role served by the front controller of the
+//config, request body is not sent to the application and neither are its length and type.
+func OptionAuthorizer(cfg *ScriptConfig) OptionRequest {
+	return func(req *Request) {
+		scriptName := path.Clean("/" + cfg.FrontController)
+
+		req.Role = RoleAuthorizer
+		req.Stdin = nil
+		req.DelParam("CONTENT_LENGTH")
+		req.DelParam("CONTENT_TYPE")
+		req.SetParam("DOCUMENT_ROOT", cfg.DocumentRoot)
+		req.SetParam("SCRIPT_NAME", scriptName)
+		req.SetParam("SCRIPT_FILENAME", path.Join(cfg.DocumentRoot, scriptName))
+	}
+}
+
+//OptionFilter switches request to the filter role, data is streamed to the application after stdin
+//and closed once sent.
+func OptionFilter(data io.ReadCloser, size int64, modTime time.Time) OptionRequest {
+	return func(req *Request) {
+		req.Role = RoleFilter
+		req.Data = data
+		req.SetParam("FCGI_DATA_LENGTH", strconv.FormatInt(size, 10))
+		req.SetParam("FCGI_DATA_LAST_MOD", strconv.FormatInt(modTime.Unix(), 10))
+	}
+}
+
+//OptionLocalRedirects makes WriteTo return *LocalRedirect instead of sending 302 when application
+//responds with path-only Location and no body (RFC 3875, 6.2.2). Server is expected to serve the
+//location as the new request.
+func OptionLocalRedirects() OptionRequest {
+	return func(req *Request) {
+		req.LocalRedirects = true
+	}
+}
+
+//OptionScript sets SCRIPT_FILENAME, SCRIPT_NAME, PATH_INFO, PATH_TRANSLATED and DOCUMENT_ROOT
+//of the request.
+func OptionScript(cfg *ScriptConfig) OptionRequest {
+	return func(req *Request) {
+		for _, param := range cfg.params(req.Raw) {
+			req.SetParam(param.Name, param.Value)
+		}
+	}
+}
+
+//buildParams derives request, server and client parameters from the http request, headers follow
+//sorted by name so the params are encoded the same way for the same request.
+func buildParams(r *http.Request) Params {
+	var params Params
+
+	params.Add("GATEWAY_INTERFACE", "CGI/1.1")
+	params.Add("SERVER_SOFTWARE", "fast-php")
+	params.Add("SERVER_PROTOCOL", r.Proto)
+	params.Add("REQUEST_METHOD", r.Method)
+
+	//client requests have no RequestURI
+	requestURI := r.RequestURI
+	if requestURI == "" {
+		requestURI = r.URL.RequestURI()
+	}
+
+	params.Add("REQUEST_URI", requestURI)
+	params.Add("QUERY_STRING", r.URL.RawQuery)
+	params.Add("CONTENT_TYPE", r.Header.Get("Content-Type"))
+
+	if r.ContentLength >= 0 {
+		params.Add("CONTENT_LENGTH", strconv.FormatInt(r.ContentLength, 10))
+	}
+
+	if r.TLS != nil {
+		params.Add("REQUEST_SCHEME", "https")
+		params.Add("HTTPS", "on")
+	} else {
+		params.Add("REQUEST_SCHEME", "http")
+	}
+
+	host, port := splitHostPort(r.Host)
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		serverAddr, localPort := splitHostPort(addr.String())
+		params.Add("SERVER_ADDR", serverAddr)
+
+		if port == "" {
+			port = localPort
+		}
+	}
+
+	if port == "" {
+		port = "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+
+	params.Add("SERVER_NAME", host)
+	params.Add("SERVER_PORT", port)
+
+	remoteAddr, remotePort := splitHostPort(r.RemoteAddr)
+	params.Add("REMOTE_ADDR", remoteAddr)
+	params.Add("REMOTE_PORT", remotePort)
+
+	params.Add("HTTP_HOST", r.Host)
+
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		//content headers are passed as CONTENT_*, Proxy header must never be passed (httpoxy) and
+		//underscores would allow to spoof variables of the other headers
+		switch {
+			case name == "Content-Type", name == "Content-Length", name == "Proxy":
+				continue
+
+			case strings.Contains(name, "_"):
+				continue
+		}
+
+		//repeated headers are folded into single param, backends keep only one value of the name
+		key := "HTTP_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		params.Set(key, foldParam(key, r.Header[name]...))
+	}
+
+	return params
+}
+
+//params maps request path onto the script. Path is split right after the first .php segment,
+//requests without it are passed to the front controller.
+func (cfg *ScriptConfig) params(r *http.Request) Params {
+	var params Params
+
+	//cleaning rooted path removes any attempt to leave document root
+	urlPath := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && urlPath != "/" {
+		urlPath += "/"
+	}
+
+	scriptName, pathInfo := splitScriptPath(urlPath)
+	if scriptName == "" {
+		switch {
+			case cfg.FrontController != "":
+				scriptName = path.Clean("/" + cfg.FrontController)
+
+			case strings.HasSuffix(urlPath, "/"):
+				scriptName = urlPath + "index" + scriptExt
+
+			default:
+				scriptName = urlPath
+		}
+	}
+
+	params.Add("DOCUMENT_ROOT", cfg.DocumentRoot)
+	params.Add("SCRIPT_NAME", scriptName)
+	params.Add("SCRIPT_FILENAME", path.Join(cfg.DocumentRoot, scriptName))
+	params.Add("PATH_INFO", pathInfo)
+
+	if pathInfo != "" {
+		params.Add("PATH_TRANSLATED", path.Join(cfg.DocumentRoot, pathInfo))
+	}
+
+	return params
+}
+
+//splitScriptPath splits path into script name and path info, script name is empty when path
+//does not point to the script.
+func splitScriptPath(urlPath string) (scriptName string, pathInfo string) {
+	for offset := 0; ; {
+		i := strings.Index(urlPath[offset:], scriptExt)
+		if i == -1 {
+			return "", ""
+		}
+
+		end := offset + i + len(scriptExt)
+		if end == len(urlPath) || urlPath[end] == '/' {
+			return urlPath[:end], urlPath[end:]
+		}
+
+		offset = end
+	}
+}
+
+//splitHostPort splits address into host and port, port is empty when address has none.
+func splitHostPort(addr string) (host string, port string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+
+	return host, port
 }
@@ -0,0 +1,190 @@
+package fastcgi
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fast-php/fastcgi/fastcgitest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitScriptPath(t *testing.T) {
+	cases := []struct {
+		path       string
+		scriptName string
+		pathInfo   string
+	}{
+		{path: "/index.php", scriptName: "/index.php"},
+		{path: "/index.php/users/1", scriptName: "/index.php", pathInfo: "/users/1"},
+		{path: "/admin/app.php/", scriptName: "/admin/app.php", pathInfo: "/"},
+		{path: "/a.phpx/b.php/c", scriptName: "/a.phpx/b.php", pathInfo: "/c"},
+		{path: "/image.php.png"},
+		{path: "/users/1"},
+		{path: "/"},
+	}
+
+	for _, c := range cases {
+		scriptName, pathInfo := splitScriptPath(c.path)
+		if scriptName != c.scriptName || pathInfo != c.pathInfo {
+			t.Errorf("%s: script %q, path info %q", c.path, scriptName, pathInfo)
+		}
+	}
+}
+
+func TestScriptParams(t *testing.T) {
+	cases := []struct {
+		name       string
+		front      string
+		uri        string
+		scriptName string
+		pathInfo   string
+		translated string
+	}{
+		{name: "script", uri: "/info.php?a=1", scriptName: "/info.php"},
+		{name: "path info", uri: "/info.php/a/b", scriptName: "/info.php", pathInfo: "/a/b", translated: "/app/a/b"},
+		{name: "front controller", front: "index.php", uri: "/users/1", scriptName: "/index.php"},
+		{name: "script over front controller", front: "index.php", uri: "/admin.php/x", scriptName: "/admin.php", pathInfo: "/x", translated: "/app/x"},
+		{name: "directory index", uri: "/docs/", scriptName: "/docs/index.php"},
+		{name: "no script", uri: "/style.css", scriptName: "/style.css"},
+		{name: "escape from root", uri: "/../../etc/passwd.php", scriptName: "/etc/passwd.php"},
+	}
+
+	for _, c := range cases {
+		cfg := &ScriptConfig{DocumentRoot: "/app", FrontController: c.front}
+		req := NewRequest(httptest.NewRequest("GET", c.uri, nil), OptionScript(cfg))
+
+		want := map[string]string{
+			"DOCUMENT_ROOT":   "/app",
+			"SCRIPT_NAME":     c.scriptName,
+			"SCRIPT_FILENAME": "/app" + c.scriptName,
+			"PATH_INFO":       c.pathInfo,
+			"PATH_TRANSLATED": c.translated,
+		}
+
+		for name, value := range want {
+			if req.Param(name) != value {
+				t.Errorf("%s: %s = %q, want %q", c.name, name, req.Param(name), value)
+			}
+		}
+	}
+}
+
+func TestBuildParams(t *testing.T) {
+	r := httptest.NewRequest("POST", "https://example.com:8443/form?a=1", strings.NewReader("name=x"))
+	r.TLS = &tls.ConnectionState{}
+	r.RemoteAddr = "10.0.0.1:51000"
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Content-Length", "6")
+	r.Header.Set("Proxy", "http://attacker")
+	r.Header["X_Forwarded_For"] = []string{"spoofed"}
+	r.Header.Set("X-Forwarded-For", "10.0.0.2")
+	r.Header.Set("User-Agent", "test")
+
+	params := buildParams(r)
+
+	want := map[string]string{
+		"GATEWAY_INTERFACE":    "CGI/1.1",
+		"REQUEST_METHOD":       "POST",
+		"REQUEST_URI":          "https://example.com:8443/form?a=1",
+		"QUERY_STRING":         "a=1",
+		"CONTENT_TYPE":         "application/x-www-form-urlencoded",
+		"CONTENT_LENGTH":       "6",
+		"REQUEST_SCHEME":       "https",
+		"HTTPS":                "on",
+		"SERVER_NAME":          "example.com",
+		"SERVER_PORT":          "8443",
+		"REMOTE_ADDR":          "10.0.0.1",
+		"REMOTE_PORT":          "51000",
+		"HTTP_HOST":            "example.com:8443",
+		"HTTP_USER_AGENT":      "test",
+		"HTTP_X_FORWARDED_FOR": "10.0.0.2",
+	}
+
+	for name, value := range want {
+		if values := params.Values(name); len(values) != 1 || values[0] != value {
+			t.Errorf("%s = %q, want %q", name, values, value)
+		}
+	}
+
+	//content headers are only passed as CONTENT_*, Proxy never (httpoxy)
+	for _, name := range []string{"HTTP_CONTENT_TYPE", "HTTP_CONTENT_LENGTH", "HTTP_PROXY"} {
+		if values := params.Values(name); len(values) != 0 {
+			t.Errorf("%s = %q", name, values)
+		}
+	}
+}
+
+func TestBuildParamsDefaultPort(t *testing.T) {
+	cases := []struct {
+		url    string
+		tls    bool
+		port   string
+		scheme string
+	}{
+		{url: "http://example.com/", port: "80", scheme: "http"},
+		{url: "https://example.com/", tls: true, port: "443", scheme: "https"},
+		{url: "http://example.com:8080/", port: "8080", scheme: "http"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.url, nil)
+		if c.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+
+		params := buildParams(r)
+		if params.Get("SERVER_PORT") != c.port || params.Get("REQUEST_SCHEME") != c.scheme {
+			t.Errorf("%s: port %q, scheme %q", c.url, params.Get("SERVER_PORT"), params.Get("REQUEST_SCHEME"))
+		}
+	}
+}
+
+func TestFilterRequest(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{
+			Header: http.Header{"Content-Type": {"text/plain"}},
+			Stdout: [][]byte{bytes.ToUpper(req.Data)},
+		}
+	})
+	defer srv.Close()
+
+	client := NewClient(srv.Dial, PoolConfig{})
+	defer client.Close()
+
+	modTime := time.Unix(1500000000, 0)
+	data := ioutil.NopCloser(strings.NewReader("file contents"))
+
+	r := httptest.NewRequest("POST", "/filter.php", strings.NewReader("stdin"))
+	resp, err := client.Do(NewRequest(r, OptionFilter(data, 13, modTime)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := resp.WriteTo(rec, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Body.String() != "FILE CONTENTS" {
+		t.Fatalf("body = %q", rec.Body.String())
+	}
+
+	reqs := srv.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("%d requests served", len(reqs))
+	}
+
+	//data follows stdin, its length and modification time are passed as params
+	got := reqs[0]
+	if got.Role != RoleFilter || string(got.Stdin) != "stdin" || string(got.Data) != "file contents" {
+		t.Fatalf("role %d, stdin %q, data %q", got.Role, got.Stdin, got.Data)
+	}
+
+	if got.Params["FCGI_DATA_LENGTH"] != "13" || got.Params["FCGI_DATA_LAST_MOD"] != "1500000000" {
+		t.Fatalf("FCGI_DATA_LENGTH %q, FCGI_DATA_LAST_MOD %q", got.Params["FCGI_DATA_LENGTH"], got.Params["FCGI_DATA_LAST_MOD"])
+	}
+}
@@ -1,3 +1,74 @@
 package fastcgi
 
+import (
+	"encoding/binary"
+	"fmt"
+)
 
+//EndRequest is decoded body of FCGI_END_REQUEST record.
+type EndRequest struct {
+	//AppStatus is exit status of the application.
+	AppStatus uint32
+
+	//ProtocolStatus tells whether backend completed or rejected the request.
+	ProtocolStatus uint8
+}
+
+func readEndRequest(b []byte) (*EndRequest, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("gofast: short FCGI_END_REQUEST body (%d bytes)", len(b))
+	}
+
+	return &EndRequest{
+		AppStatus:      binary.BigEndian.Uint32(b),
+		ProtocolStatus: b[4],
+	}, nil
+}
+
+//Err maps protocol status to one of the sentinel errors, nil is returned for completed requests.
+func (e *EndRequest) Err() error {
+	switch e.ProtocolStatus {
+		case statusRequestComplete:
+			return nil
+
+		case statusCantMultiplex:
+			return ErrCantMultiplex
+
+		case statusOverloaded:
+			return ErrOverloaded
+
+		case statusUnknownRole:
+			return ErrUnknownRole
+
+		default:
+			return fmt.Errorf("gofast: unknown protocol status %d", e.ProtocolStatus)
+	}
+}
+
+//AbortError is reported when request context is done before the backend ended the request,
+//FCGI_ABORT_REQUEST is sent to the backend in such case.
+type AbortError struct {
+	//Cause is the error of the request context.
+	Cause error
+
+	//Ended tells whether backend ended the request in time, connection is dropped otherwise.
+	Ended bool
+}
+
+func (e *AbortError) Error() string {
+	if e.Ended {
+		return fmt.Sprintf("gofast: request aborted: %v", e.Cause)
+	}
+
+	return fmt.Sprintf("gofast: request aborted: %v, backend did not end the request", e.Cause)
+}
+
+//LocalRedirect is returned by WriteTo for CGI local redirect, response has not been written.
+type LocalRedirect struct {
+	//Location is path and query of the local resource.
+	Location string
+}
+
+func (e *LocalRedirect) Error() string {
+	return fmt.Sprintf("gofast: local redirect to %s", e.Location)
+}
@@ -0,0 +1,203 @@
+package fastcgi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	//headerSendfile points to the file by its absolute path, as with Apache mod_xsendfile.
+	headerSendfile = "X-Sendfile"
+
+	//headerAccelRedirect points to the file by its URI in one of the internal locations, as with nginx.
+	headerAccelRedirect = "X-Accel-Redirect"
+)
+
+var errSendfileForbidden = errors.New("gofast: sendfile target is outside of the allowed locations")
+
+//SendfileConfig allows application to hand file downloads over to the server using X-Sendfile and
+//X-Accel-Redirect response headers. Files outside of the configured directories are never served.
+type SendfileConfig struct {
+	//Roots lists directories X-Sendfile paths must be located in.
+	Roots []string
+
+	//Locations maps internal URI prefixes of X-Accel-Redirect onto directories, e.g. "/protected/"
+	//onto "/var/www/private". Prefixes match whole path segments.
+	Locations map[string]string
+}
+
+//Valid validates the configuration.
+func (cfg *SendfileConfig) Valid() error {
+	for _, root := range cfg.Roots {
+		if !filepath.IsAbs(root) {
+			return fmt.Errorf("sendfile root must be absolute: %q", root)
+		}
+	}
+
+	for prefix, dir := range cfg.Locations {
+		if !strings.HasPrefix(prefix, "/") || !filepath.IsAbs(dir) {
+			return fmt.Errorf("invalid sendfile location %q: %q", prefix, dir)
+		}
+	}
+
+	return nil
+}
+
+//OptionSendfile serves files pointed to by X-Sendfile and X-Accel-Redirect headers of the response
+//instead of passing the headers to the client.
+func OptionSendfile(cfg *SendfileConfig) OptionRequest {
+	return func(req *Request) {
+		req.Sendfile = cfg
+	}
+}
+
+//target removes offload headers from the response and returns file they point to, filename is
+//empty when response has none.
+func (cfg *SendfileConfig) target(headers http.Header) (filename string, err error) {
+	sendfile, redirect := headers.Get(headerSendfile), headers.Get(headerAccelRedirect)
+	headers.Del(headerSendfile)
+	headers.Del(headerAccelRedirect)
+
+	switch {
+		case sendfile != "":
+			return cfg.root(sendfile)
+
+		case redirect != "":
+			return cfg.location(redirect)
+	}
+
+	return "", nil
+}
+
+//root checks that absolute path is located in one of the roots.
+func (cfg *SendfileConfig) root(filename string) (string, error) {
+	if !filepath.IsAbs(filename) {
+		return "", errSendfileForbidden
+	}
+
+	filename = filepath.Clean(filename)
+	for _, root := range cfg.Roots {
+		if within(filename, root) {
+			return resolve(filename, root)
+		}
+	}
+
+	return "", errSendfileForbidden
+}
+
+//location maps URI onto the directory of the longest matching location.
+func (cfg *SendfileConfig) location(uri string) (string, error) {
+	if i := strings.IndexByte(uri, '?'); i != -1 {
+		uri = uri[:i]
+	}
+
+	uri, err := url.PathUnescape(uri)
+	if err != nil {
+		return "", errSendfileForbidden
+	}
+
+	var prefix, dir string
+	for p, d := range cfg.Locations {
+		if matchPrefix(uri, p) && len(p) > len(prefix) {
+			prefix, dir = p, d
+		}
+	}
+
+	if prefix == "" {
+		return "", errSendfileForbidden
+	}
+
+	//cleaning rooted path removes any attempt to leave the location
+	rel := path.Clean("/" + strings.TrimPrefix(uri, prefix))
+
+	return resolve(filepath.Join(dir, filepath.FromSlash(rel)), dir)
+}
+
+//matchPrefix reports whether URI is located under the prefix, prefix must end at the segment
+//boundary so "/files" does not match "/files-secret/".
+func matchPrefix(uri string, prefix string) bool {
+	if !strings.HasPrefix(uri, prefix) {
+		return false
+	}
+
+	return strings.HasSuffix(prefix, "/") || len(uri) == len(prefix) || uri[len(prefix)] == '/'
+}
+
+//resolve follows symlinks of the file, file must stay within the directory.
+func resolve(filename string, dir string) (string, error) {
+	realFile, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return "", err
+	}
+
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if !within(realFile, realDir) {
+		return "", errSendfileForbidden
+	}
+
+	return realFile, nil
+}
+
+func within(filename string, dir string) bool {
+	dir = filepath.Clean(dir)
+	if dir == string(filepath.Separator) {
+		return true
+	}
+
+	return strings.HasPrefix(filename, dir+string(filepath.Separator))
+}
+
+//serveFile sends the file in place of the response body, headers of the application are kept
+//except for the content length. Range and conditional requests are handled by http.ServeContent.
+func serveFile(w http.ResponseWriter, r *http.Request, headers http.Header, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return errSendfileForbidden
+	}
+
+	headers.Del("Content-Length")
+	for k, vv := range headers {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+
+	return nil
+}
+
+//sendfileStatus returns http status for the file which could not be served.
+func sendfileStatus(err error) int {
+	switch {
+		case os.IsNotExist(err):
+			return http.StatusNotFound
+
+		case err == errSendfileForbidden, os.IsPermission(err):
+			return http.StatusForbidden
+
+		default:
+			return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,168 @@
+package fastcgi
+
+import (
+	"fast-php/fastcgi/fastcgitest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//sendfileDirs creates public directory with file.txt and private one with secret.txt, public
+//directory links to the secret.
+func sendfileDirs(t *testing.T) (public, private string) {
+	dir, err := ioutil.TempDir("", "sendfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	public, private = filepath.Join(dir, "public"), filepath.Join(dir, "private")
+	for _, d := range []string{public, private} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(public, "file.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(private, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(filepath.Join(private, "secret.txt"), filepath.Join(public, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	return public, private
+}
+
+func TestSendfileTarget(t *testing.T) {
+	public, private := sendfileDirs(t)
+
+	//roots and locations which are string prefixes of the others must not match them
+	cfg := &SendfileConfig{
+		Roots:     []string{public + string(filepath.Separator), strings.TrimSuffix(private, "ate")},
+		Locations: map[string]string{"/protected/": public, "/files": public},
+	}
+
+	cases := []struct {
+		header, value string
+		file          string
+		err           error
+	}{
+		{headerSendfile, filepath.Join(public, "file.txt"), "file.txt", nil},
+		{headerSendfile, "file.txt", "", errSendfileForbidden},
+		{headerSendfile, filepath.Join(public, "..", "private", "secret.txt"), "", errSendfileForbidden},
+		{headerSendfile, "/etc/passwd", "", errSendfileForbidden},
+		{headerSendfile, filepath.Join(public, "link.txt"), "", errSendfileForbidden},
+		{headerAccelRedirect, "/protected/file.txt?v=1", "file.txt", nil},
+		{headerAccelRedirect, "/protected/../../private/secret.txt", "", os.ErrNotExist},
+		{headerAccelRedirect, "/protected/%2e%2e/private/secret.txt", "", os.ErrNotExist},
+		{headerAccelRedirect, "/protected/link.txt", "", errSendfileForbidden},
+		{headerAccelRedirect, "/public/file.txt", "", errSendfileForbidden},
+		{headerSendfile, filepath.Join(private, "secret.txt"), "", errSendfileForbidden},
+		{headerAccelRedirect, "/files/file.txt", "file.txt", nil},
+		{headerAccelRedirect, "/files-secret/file.txt", "", errSendfileForbidden},
+	}
+
+	for _, tc := range cases {
+		headers := http.Header{tc.header: {tc.value}}
+
+		filename, err := cfg.target(headers)
+		switch {
+			case tc.err == os.ErrNotExist && !os.IsNotExist(err),
+				tc.err != os.ErrNotExist && err != tc.err:
+				t.Fatalf("%s: %s: error %v, expected %v", tc.header, tc.value, err, tc.err)
+
+			case tc.file != "" && filepath.Base(filename) != tc.file:
+				t.Fatalf("%s: %s: file %q", tc.header, tc.value, filename)
+		}
+
+		if len(headers) != 0 {
+			t.Fatalf("%s: offload headers left in the response: %v", tc.header, headers)
+		}
+	}
+}
+
+func TestSendfileResponse(t *testing.T) {
+	public, _ := sendfileDirs(t)
+	cfg := &SendfileConfig{Roots: []string{public}}
+
+	srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{
+			Status: 200,
+			Header: http.Header{
+				"Content-Type":  {"text/plain"},
+				"Cache-Control": {"private"},
+				headerSendfile:  {filepath.Join(public, req.Params["QUERY_STRING"])},
+			},
+			Stdout: [][]byte{[]byte("body of the application")},
+		}
+	})
+	defer srv.Close()
+
+	c := NewClient(srv.Dial, PoolConfig{})
+	defer c.Close()
+
+	modTime := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	cases := []struct {
+		name     string
+		query    string
+		header   http.Header
+		buffered bool
+		status   int
+		body     string
+	}{
+		{"whole file", "file.txt", nil, false, 200, "0123456789"},
+		{"range", "file.txt", http.Header{"Range": {"bytes=2-4"}}, false, 206, "234"},
+		{"not modified", "file.txt", http.Header{"If-Modified-Since": {modTime}}, false, 304, ""},
+		{"buffered", "file.txt", http.Header{"Range": {"bytes=-3"}}, true, 206, "789"},
+		{"missing", "missing.txt", nil, false, 404, ""},
+		{"symlink escape", "link.txt", nil, false, 403, ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/download?"+tc.query, nil)
+			for k, vv := range tc.header {
+				r.Header[k] = vv
+			}
+
+			opts := []OptionRequest{OptionSendfile(cfg)}
+			if tc.buffered {
+				opts = append(opts, OptionBuffered(&BodyBuffer{}))
+			}
+
+			resp, err := c.Do(NewRequest(r, opts...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			_ = resp.WriteTo(rec, ioutil.Discard)
+
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			if rec.Code != tc.status || tc.body != "" && rec.Body.String() != tc.body {
+				t.Fatalf("status %d, body %q", rec.Code, rec.Body.String())
+			}
+
+			if tc.status < 300 && (rec.Header().Get("Cache-Control") != "private" || rec.Header().Get(headerSendfile) != "") {
+				t.Fatalf("headers %v", rec.Header())
+			}
+		})
+	}
+}
@@ -0,0 +1,553 @@
+package fastcgi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+//request body buffered ahead of the handler by default
+const defaultBodyBuffer = 8 * 1024 * 1024
+
+var errRequestAborted = errors.New("gofast: request aborted by the web server")
+
+var errBodyBufferFull = errors.New("gofast: request body sent faster than the handler reads it")
+
+//Serve accepts FastCGI connections on the listener and serves responder requests using the handler,
+//http.DefaultServeMux is used when handler is nil.
+func Serve(l net.Listener, handler http.Handler) error {
+	srv := &Server{Handler: handler}
+
+	return srv.Serve(l)
+}
+
+//Server is FastCGI responder passing requests of the web server (nginx, Apache) to the http handler.
+//Concurrent requests over the same connection are served even when multiplexing is not advertised.
+type Server struct {
+	//Handler serves requests, http.DefaultServeMux is used when nil.
+	Handler http.Handler
+
+	//Multiplex is reported as FCGI_MPXS_CONNS, web servers only send concurrent requests over
+	//the same connection when it is set.
+	Multiplex bool
+
+	//MaxConns is reported as FCGI_MAX_CONNS, zero leaves the variable out of the reply.
+	MaxConns int
+
+	//MaxReqs limits concurrent requests over all connections, requests above the limit are
+	//rejected as overloaded. Zero means no limit.
+	MaxReqs int
+
+	//MaxBodyBuffer limits request body received ahead of the handler, request whose unread body
+	//exceeds the limit is canceled and its body fails. Defaults to 8MB.
+	MaxBodyBuffer int64
+
+	//ErrorLog logs panics of the handler, standard logger is used when nil.
+	ErrorLog *log.Logger
+
+	//amount of requests being served
+	active int64
+}
+
+//Serve accepts connections until listener fails.
+func (srv *Server) Serve(l net.Listener) error {
+	defer func() {
+		_ = l.Close()
+	}()
+
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		sc := &serverConn{
+			srv:  srv,
+			conn: newConn(rwc),
+			reqs: make(map[uint16]*serverRequest),
+		}
+
+		go sc.serve()
+	}
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (srv *Server) handler() http.Handler {
+	if srv.Handler == nil {
+		return http.DefaultServeMux
+	}
+
+	return srv.Handler
+}
+
+//serverConn reads records of single web server connection.
+type serverConn struct {
+	srv  *Server
+	conn *conn
+
+	mu   sync.Mutex
+	reqs map[uint16]*serverRequest
+}
+
+//serverRequest is request being received or served.
+type serverRequest struct {
+	id       uint16
+	keepConn bool
+	params   bytes.Buffer
+	started  bool
+
+	//request body, written by the connection reader
+	stdin *requestBody
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (sc *serverConn) serve() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	defer func() {
+		cancel()
+		sc.abortAll()
+		_ = sc.conn.Close()
+	}()
+
+	var rec serviceRecord
+	for {
+		if err := rec.read(sc.conn.rwc); err != nil {
+			return
+		}
+
+		if err := sc.handleRecord(ctx, &rec); err != nil {
+			return
+		}
+	}
+}
+
+func (sc *serverConn) handleRecord(ctx context.Context, rec *serviceRecord) error {
+	if rec.h.ID == 0 {
+		if rec.h.Type == typeGetValues {
+			return sc.writeValues(rec.body())
+		}
+
+		return sc.writeUnknownType(rec.h.Type)
+	}
+
+	if rec.h.Type == typeBeginRequest {
+		return sc.beginRequest(ctx, rec)
+	}
+
+	sc.mu.Lock()
+	req, ok := sc.reqs[rec.h.ID]
+	sc.mu.Unlock()
+
+	//records of the finished or rejected requests
+	if !ok {
+		return nil
+	}
+
+	switch rec.h.Type {
+		case typeParams:
+			if len(rec.body()) > 0 {
+				req.params.Write(rec.body())
+				return nil
+			}
+
+			params, err := parsePairs(req.params.Bytes())
+			if err != nil {
+				return sc.endRequest(req, 1, statusRequestComplete)
+			}
+
+			req.started = true
+			go sc.serveRequest(req, params)
+
+		case typeStdin:
+			if !req.started {
+				return sc.endRequest(req, 1, statusRequestComplete)
+			}
+
+			if len(rec.body()) == 0 {
+				req.stdin.closeWithError(io.EOF)
+				return nil
+			}
+
+			//buffered so the handler reading slowly does not hold up other requests of the connection
+			if !req.stdin.write(rec.body()) {
+				req.cancel()
+			}
+
+		case typeAbortRequest:
+			req.cancel()
+			req.stdin.closeWithError(errRequestAborted)
+
+			if !req.started {
+				return sc.endRequest(req, 0, statusRequestComplete)
+			}
+	}
+
+	return nil
+}
+
+func (sc *serverConn) beginRequest(ctx context.Context, rec *serviceRecord) error {
+	b := rec.body()
+	if len(b) < 8 {
+		return fmt.Errorf("gofast: short FCGI_BEGIN_REQUEST body (%d bytes)", len(b))
+	}
+
+	role := binary.BigEndian.Uint16(b)
+	if role != RoleResponder {
+		return sc.conn.writeEndRequest(rec.h.ID, 0, statusUnknownRole)
+	}
+
+	if limit := int64(sc.srv.MaxReqs); limit > 0 && atomic.AddInt64(&sc.srv.active, 1) > limit {
+		atomic.AddInt64(&sc.srv.active, -1)
+		return sc.conn.writeEndRequest(rec.h.ID, 0, statusOverloaded)
+	}
+
+	req := &serverRequest{
+		id:       rec.h.ID,
+		keepConn: b[2]&1 != 0,
+	}
+
+	req.stdin = newRequestBody(sc.srv.MaxBodyBuffer)
+	req.ctx, req.cancel = context.WithCancel(ctx)
+
+	sc.mu.Lock()
+	sc.reqs[req.id] = req
+	sc.mu.Unlock()
+
+	return nil
+}
+
+//serveRequest rebuilds http request from the params and passes it to the handler.
+func (sc *serverConn) serveRequest(req *serverRequest, params map[string]string) {
+	r, err := cgi.RequestFromMap(params)
+	if err != nil {
+		w := newWriter(sc.conn, typeStderr, req.id)
+		_, _ = w.WriteString(err.Error())
+		_ = w.Close()
+
+		_ = sc.endRequest(req, 1, statusRequestComplete)
+		return
+	}
+
+	r.Body = req.stdin
+	r = r.WithContext(req.ctx)
+
+	resp := newResponse(sc.conn, req.id)
+	ok := sc.serveHTTP(resp, r)
+	_ = resp.Close()
+
+	//body which has not been read is of no use anymore
+	_ = req.stdin.Close()
+
+	appStatus := 0
+	if !ok || req.stdin.exceeded() {
+		appStatus = 1
+	}
+
+	if err := sc.endRequest(req, appStatus, statusRequestComplete); err != nil || !req.keepConn {
+		_ = sc.conn.Close()
+	}
+}
+
+//serveHTTP passes request to the handler, false is returned when the handler panicked.
+func (sc *serverConn) serveHTTP(w http.ResponseWriter, r *http.Request) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				sc.srv.logf("gofast: panic serving %s: %v\n%s", r.RequestURI, err, debug.Stack())
+			}
+
+			ok = false
+		}
+	}()
+
+	sc.srv.handler().ServeHTTP(w, r)
+
+	return true
+}
+
+//endRequest sends FCGI_END_REQUEST and forgets about the request.
+func (sc *serverConn) endRequest(req *serverRequest, appStatus int, protocolStatus uint8) error {
+	sc.mu.Lock()
+	delete(sc.reqs, req.id)
+	sc.mu.Unlock()
+
+	req.cancel()
+	req.stdin.closeWithError(errRequestAborted)
+
+	if sc.srv.MaxReqs > 0 {
+		atomic.AddInt64(&sc.srv.active, -1)
+	}
+
+	return sc.conn.writeEndRequest(req.id, appStatus, protocolStatus)
+}
+
+//abortAll cancels requests of the closed connection, requests which have not been passed to the
+//handler are forgotten right away.
+func (sc *serverConn) abortAll() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for id, req := range sc.reqs {
+		req.cancel()
+		req.stdin.closeWithError(errRequestAborted)
+
+		if !req.started {
+			delete(sc.reqs, id)
+
+			if sc.srv.MaxReqs > 0 {
+				atomic.AddInt64(&sc.srv.active, -1)
+			}
+		}
+	}
+}
+
+//requestBody buffers stdin of the request until the handler reads it, so the connection reader
+//never waits for the handler. Web servers send the body as fast as the network allows, so unread
+//part of the body held in memory is limited.
+type requestBody struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	buf   bytes.Buffer
+	limit int
+
+	//io.EOF once the whole body has been received, set only once
+	err error
+}
+
+func newRequestBody(limit int64) *requestBody {
+	if limit <= 0 {
+		limit = defaultBodyBuffer
+	}
+
+	b := &requestBody{limit: int(limit)}
+	b.cond = sync.NewCond(&b.mu)
+
+	return b
+}
+
+//write appends chunk of the body, chunks after the body has been closed are dropped. False is
+//returned when the chunk exceeded the limit, body fails then.
+func (b *requestBody) write(p []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return true
+	}
+
+	if b.buf.Len()+len(p) > b.limit {
+		b.err = errBodyBufferFull
+		b.buf.Reset()
+		b.cond.Broadcast()
+
+		return false
+	}
+
+	b.buf.Write(p)
+	b.cond.Signal()
+
+	return true
+}
+
+//exceeded reports whether the body failed by exceeding the limit.
+func (b *requestBody) exceeded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.err == errBodyBufferFull
+}
+
+//closeWithError ends the body, data not read yet is dropped unless the body is complete.
+func (b *requestBody) closeWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return
+	}
+
+	b.err = err
+	if err != io.EOF {
+		b.buf.Reset()
+	}
+
+	b.cond.Broadcast()
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.buf.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+
+	if b.buf.Len() != 0 {
+		return b.buf.Read(p)
+	}
+
+	return 0, b.err
+}
+
+//Close drops the body, it is called once the handler is done with the request.
+func (b *requestBody) Close() error {
+	b.closeWithError(http.ErrBodyReadAfterClose)
+
+	b.mu.Lock()
+	b.buf.Reset()
+	b.mu.Unlock()
+
+	return nil
+}
+
+//writeValues replies to FCGI_GET_VALUES with the variables known to the server.
+func (sc *serverConn) writeValues(body []byte) error {
+	query, err := parsePairs(body)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]string{
+		ValueMpxsConns: "0",
+	}
+
+	if sc.srv.Multiplex {
+		values[ValueMpxsConns] = "1"
+	}
+
+	if sc.srv.MaxConns > 0 {
+		values[ValueMaxConns] = strconv.Itoa(sc.srv.MaxConns)
+	}
+
+	if sc.srv.MaxReqs > 0 {
+		values[ValueMaxReqs] = strconv.Itoa(sc.srv.MaxReqs)
+	}
+
+	var reply bytes.Buffer
+	b := make([]byte, 8)
+
+	for name := range query {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+
+		n := encodeSize(b, uint32(len(name)))
+		n += encodeSize(b[n:], uint32(len(value)))
+
+		reply.Write(b[:n])
+		reply.WriteString(name)
+		reply.WriteString(value)
+	}
+
+	return sc.conn.writeRecord(typeGetValuesResult, 0, reply.Bytes())
+}
+
+//writeUnknownType replies to management record server does not understand.
+func (sc *serverConn) writeUnknownType(recType recType) error {
+	b := [8]byte{byte(recType)}
+
+	return sc.conn.writeRecord(typeUnknownType, 0, b[:])
+}
+
+//response writes http response as CGI headers and body into the stdout stream.
+type response struct {
+	w           *bufWriter
+	header      http.Header
+	code        int
+	wroteHeader bool
+	wroteCGI    bool
+}
+
+func newResponse(c *conn, reqID uint16) *response {
+	return &response{
+		w:      newWriter(c, typeStdout, reqID),
+		header: make(http.Header),
+	}
+}
+
+func (r *response) Header() http.Header {
+	return r.header
+}
+
+func (r *response) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+
+	r.wroteHeader = true
+	r.code = code
+
+	if code == http.StatusNotModified {
+		r.header.Del("Content-Type")
+		r.header.Del("Content-Length")
+		r.header.Del("Transfer-Encoding")
+	}
+}
+
+func (r *response) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	if !r.wroteCGI {
+		r.writeCGIHeader(p)
+	}
+
+	return r.w.Write(p)
+}
+
+//writeCGIHeader sends status and headers, content type is sniffed from the first chunk of the body
+//when not set by the handler.
+func (r *response) writeCGIHeader(p []byte) {
+	r.wroteCGI = true
+
+	if r.code != http.StatusNotModified && r.header.Get("Content-Type") == "" {
+		r.header.Set("Content-Type", http.DetectContentType(p))
+	}
+
+	_, _ = fmt.Fprintf(r.w, "Status: %d %s\r\n", r.code, http.StatusText(r.code))
+	_ = r.header.Write(r.w)
+	_, _ = r.w.WriteString("\r\n")
+}
+
+//Flush sends buffered response to the web server.
+func (r *response) Flush() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	if !r.wroteCGI {
+		r.writeCGIHeader(nil)
+	}
+
+	_ = r.w.Flush()
+}
+
+//Close flushes the response and ends stdout stream.
+func (r *response) Close() error {
+	r.Flush()
+
+	return r.w.Close()
+}
@@ -0,0 +1,420 @@
+package fastcgi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//webServer is web server side of the connection served by the responder.
+type webServer struct {
+	t *testing.T
+	*conn
+	nc net.Conn
+
+	//stdout received so far by request ID
+	stdout map[uint16]*bytes.Buffer
+}
+
+//serveWeb serves single connection by the server.
+func serveWeb(t *testing.T, srv *Server) *webServer {
+	t.Helper()
+
+	client, server := net.Pipe()
+
+	sc := &serverConn{
+		srv:  srv,
+		conn: newConn(server),
+		reqs: make(map[uint16]*serverRequest),
+	}
+
+	go sc.serve()
+
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return &webServer{t: t, conn: newConn(client), nc: client, stdout: make(map[uint16]*bytes.Buffer)}
+}
+
+//begin starts GET request of given URI.
+func (ws *webServer) begin(reqID uint16, uri string, keepConn bool) {
+	var flags uint8
+	if keepConn {
+		flags = 1
+	}
+
+	_ = ws.writeBeginRequest(reqID, RoleResponder, flags)
+	_ = ws.writePairs(typeParams, reqID, Params{
+		{"REQUEST_METHOD", "GET"},
+		{"SERVER_PROTOCOL", "HTTP/1.1"},
+		{"REQUEST_URI", uri},
+	})
+}
+
+//send sends the body as stdin of the request.
+func (ws *webServer) send(reqID uint16, body []byte) {
+	w := newWriter(ws.conn, typeStdin, reqID)
+	_, _ = w.Write(body)
+	_ = w.Close()
+}
+
+//end reads records until the request ends, it returns its stdout and protocol status.
+func (ws *webServer) end(reqID uint16) (string, uint8) {
+	ws.t.Helper()
+
+	var rec serviceRecord
+	for {
+		if err := ws.readRecord(&rec); err != nil {
+			ws.t.Fatalf("request %d has not ended: %v", reqID, err)
+		}
+
+		switch rec.h.Type {
+			case typeStdout:
+				if ws.stdout[rec.h.ID] == nil {
+					ws.stdout[rec.h.ID] = new(bytes.Buffer)
+				}
+
+				ws.stdout[rec.h.ID].Write(rec.body())
+
+			case typeEndRequest:
+				if rec.h.ID != reqID {
+					continue
+				}
+
+				var stdout string
+				if b := ws.stdout[reqID]; b != nil {
+					stdout = b.String()
+				}
+
+				return stdout, rec.body()[4]
+		}
+	}
+}
+
+func TestServerSlowBodyReader(t *testing.T) {
+	release := make(chan struct{})
+
+	ws := serveWeb(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s read %d", r.URL.Path, len(body))
+	})})
+
+	go func() {
+		ws.begin(1, "/slow", true)
+		ws.send(1, bytes.Repeat([]byte("x"), 1<<20))
+
+		ws.begin(2, "/fast", true)
+		ws.send(2, nil)
+	}()
+
+	//body of the request whose handler does not read it must not hold up the connection
+	if stdout, _ := ws.end(2); !strings.HasSuffix(stdout, "/fast read 0") {
+		t.Fatalf("stdout = %q", stdout)
+	}
+
+	close(release)
+
+	if stdout, _ := ws.end(1); !strings.HasSuffix(stdout, fmt.Sprintf("/slow read %d", 1<<20)) {
+		t.Fatalf("stdout = %q", stdout)
+	}
+}
+
+func TestServerBodyBufferLimit(t *testing.T) {
+	ws := serveWeb(t, &Server{MaxBodyBuffer: 64 * 1024, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//handler does not read the body until the request is canceled
+		<-r.Context().Done()
+
+		_, err := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "body error: %v", err)
+	})})
+
+	go func() {
+		ws.begin(1, "/", true)
+		ws.send(1, bytes.Repeat([]byte("x"), 1<<20))
+	}()
+
+	if stdout, _ := ws.end(1); !strings.HasSuffix(stdout, "body error: "+errBodyBufferFull.Error()) {
+		t.Fatalf("stdout = %q", stdout)
+	}
+}
+
+func TestServerMultiplexValue(t *testing.T) {
+	for _, multiplex := range []bool{false, true} {
+		ws := serveWeb(t, &Server{Multiplex: multiplex})
+
+		values, err := queryValues(context.Background(), ws.nc, ValueMpxsConns)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := map[bool]string{false: "0", true: "1"}[multiplex]; values[ValueMpxsConns] != want {
+			t.Fatalf("multiplex %v reported as %q", multiplex, values[ValueMpxsConns])
+		}
+	}
+}
+
+//serverDialer serves every dialed connection by the server, first connection is the probe of
+//the multiplexing pool.
+func serverDialer(srv *Server, dialed *int32) Dialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		client, server := net.Pipe()
+
+		sc := &serverConn{
+			srv:  srv,
+			conn: newConn(server),
+			reqs: make(map[uint16]*serverRequest),
+		}
+
+		go sc.serve()
+		atomic.AddInt32(dialed, 1)
+
+		return client, nil
+	}
+}
+
+func TestServerRoundTrip(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		w.Header().Set("X-Method", r.Method)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s", r.URL.RequestURI(), body)
+	})}
+
+	var dialed int32
+	c := NewClient(serverDialer(srv, &dialed), PoolConfig{})
+	defer c.Close()
+
+	resp, err := c.Do(NewRequest(httptest.NewRequest("POST", "/path?q=1", strings.NewReader("payload"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := resp.WriteTo(rec, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-Method") != "POST" || rec.Body.String() != "/path?q=1 payload" {
+		t.Fatalf("status %d, header %v, body %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+}
+
+func TestServerClosesConnection(t *testing.T) {
+	ws := serveWeb(t, &Server{Handler: http.NotFoundHandler()})
+
+	go func() {
+		ws.begin(1, "/", false)
+		ws.send(1, nil)
+	}()
+
+	if _, status := ws.end(1); status != statusRequestComplete {
+		t.Fatalf("protocol status %d", status)
+	}
+
+	var rec serviceRecord
+	if err := rec.read(ws.nc); err != io.EOF {
+		t.Fatalf("connection without FCGI_KEEP_CONN is open, read returned %v", err)
+	}
+}
+
+func TestServerAbortCancelsContext(t *testing.T) {
+	started, canceled := make(chan struct{}), make(chan struct{})
+
+	ws := serveWeb(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(canceled)
+	})})
+
+	go func() {
+		ws.begin(1, "/", true)
+		ws.send(1, nil)
+		<-started
+		_ = ws.writeAbortRequest(1)
+	}()
+
+	if _, status := ws.end(1); status != statusRequestComplete {
+		t.Fatalf("protocol status %d", status)
+	}
+
+	select {
+		case <-canceled:
+		default:
+			t.Fatal("context of the aborted request has not been canceled")
+	}
+}
+
+func TestServerOverloaded(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	ws := serveWeb(t, &Server{MaxReqs: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})})
+
+	go func() {
+		ws.begin(1, "/", true)
+		ws.send(1, nil)
+		<-started
+		ws.begin(2, "/", true)
+	}()
+
+	if _, status := ws.end(2); status != statusOverloaded {
+		t.Fatalf("request above MaxReqs ended with protocol status %d", status)
+	}
+
+	close(release)
+
+	if _, status := ws.end(1); status != statusRequestComplete {
+		t.Fatalf("protocol status %d", status)
+	}
+}
+
+func TestServerIncompleteRequestReleased(t *testing.T) {
+	srv := &Server{MaxReqs: 1, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})}
+
+	//connection closes before params of the request are complete
+	ws := serveWeb(t, srv)
+	_ = ws.writeBeginRequest(1, RoleResponder, 1)
+	_ = ws.nc.Close()
+
+	for i := 0; atomic.LoadInt64(&srv.active) != 0; i++ {
+		if i == 100 {
+			t.Fatal("request of the closed connection is still counted")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ws = serveWeb(t, srv)
+	go func() {
+		ws.begin(1, "/", true)
+		ws.send(1, nil)
+	}()
+
+	if stdout, status := ws.end(1); status != statusRequestComplete || !strings.HasSuffix(stdout, "ok") {
+		t.Fatalf("protocol status %d, stdout %q", status, stdout)
+	}
+}
+
+func TestServerHandlerPanic(t *testing.T) {
+	var logged bytes.Buffer
+
+	ws := serveWeb(t, &Server{ErrorLog: log.New(&logged, "", 0), Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("broken handler")
+		}
+
+		fmt.Fprint(w, "ok")
+	})})
+
+	go func() {
+		ws.begin(1, "/panic", true)
+		ws.send(1, nil)
+	}()
+
+	if _, status := ws.end(1); status != statusRequestComplete {
+		t.Fatalf("protocol status %d", status)
+	}
+
+	if !strings.Contains(logged.String(), "broken handler") {
+		t.Fatalf("panic was not logged: %q", logged.String())
+	}
+
+	//connection keeps serving
+	go func() {
+		ws.begin(2, "/", true)
+		ws.send(2, nil)
+	}()
+
+	if stdout, _ := ws.end(2); !strings.HasSuffix(stdout, "ok") {
+		t.Fatalf("stdout = %q", stdout)
+	}
+}
+
+func TestServerUnknownRole(t *testing.T) {
+	ws := serveWeb(t, &Server{})
+
+	for _, role := range []uint16{RoleAuthorizer, RoleFilter, 42} {
+		go func(role uint16) {
+			_ = ws.writeBeginRequest(1, role, 1)
+		}(role)
+
+		if _, status := ws.end(1); status != statusUnknownRole {
+			t.Fatalf("role %d ended with protocol status %d", role, status)
+		}
+	}
+}
+
+func TestServerMultiplexed(t *testing.T) {
+	const n = 8
+
+	//every handler waits for the others, so requests have to be served concurrently
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+
+	srv := &Server{Multiplex: true, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+
+		_, _ = w.Write([]byte(r.URL.Path))
+	})}
+
+	var dialed int32
+	c := NewClient(serverDialer(srv, &dialed), PoolConfig{Multiplex: true})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+
+			if body, err := get(c, path); err != nil || body != path {
+				t.Errorf("body %q, error %v", body, err)
+			}
+		}(fmt.Sprintf("/%d", i))
+	}
+
+	wait := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(wait)
+	}()
+
+	select {
+		case <-wait:
+		case <-time.After(5 * time.Second):
+			t.Fatal("multiplexed requests were not served concurrently")
+	}
+
+	//probe and the connection shared by the requests
+	if dialed := atomic.LoadInt32(&dialed); dialed != 2 {
+		t.Fatalf("%d connections dialed", dialed)
+	}
+}
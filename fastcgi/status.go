@@ -0,0 +1,140 @@
+package fastcgi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//PoolStatus is php-fpm status page (pm.status_path) of the pool.
+type PoolStatus struct {
+	Pool               string          `json:"pool"`
+	ProcessManager     string          `json:"processManager"`
+	StartTime          time.Time       `json:"startTime"`
+	AcceptedConns      uint64          `json:"acceptedConns"`
+	ListenQueue        int             `json:"listenQueue"`
+	MaxListenQueue     int             `json:"maxListenQueue"`
+	ListenQueueLen     int             `json:"listenQueueLen"`
+	IdleProcesses      int             `json:"idleProcesses"`
+	ActiveProcesses    int             `json:"activeProcesses"`
+	TotalProcesses     int             `json:"totalProcesses"`
+	MaxActiveProcesses int             `json:"maxActiveProcesses"`
+	MaxChildrenReached uint64          `json:"maxChildrenReached"`
+	SlowRequests       uint64          `json:"slowRequests"`
+	Processes          []ProcessStatus `json:"processes,omitempty"`
+}
+
+//ProcessStatus describes process of the pool and its current or last request, available with
+//full status only.
+type ProcessStatus struct {
+	PID               int           `json:"pid"`
+	State             string        `json:"state"`
+	StartTime         time.Time     `json:"startTime"`
+	Requests          uint64        `json:"requests"`
+	RequestDuration   time.Duration `json:"requestDuration"`
+	RequestMethod     string        `json:"requestMethod"`
+	RequestURI        string        `json:"requestUri"`
+	ContentLength     int64         `json:"contentLength"`
+	User              string        `json:"user"`
+	Script            string        `json:"script"`
+	LastRequestCPU    float64       `json:"lastRequestCpu"`
+	LastRequestMemory uint64        `json:"lastRequestMemory"`
+}
+
+//fpmStatus is json format of the status page.
+type fpmStatus struct {
+	Pool               string       `json:"pool"`
+	ProcessManager     string       `json:"process manager"`
+	StartTime          int64        `json:"start time"`
+	AcceptedConn       uint64       `json:"accepted conn"`
+	ListenQueue        int          `json:"listen queue"`
+	MaxListenQueue     int          `json:"max listen queue"`
+	ListenQueueLen     int          `json:"listen queue len"`
+	IdleProcesses      int          `json:"idle processes"`
+	ActiveProcesses    int          `json:"active processes"`
+	TotalProcesses     int          `json:"total processes"`
+	MaxActiveProcesses int          `json:"max active processes"`
+	MaxChildrenReached uint64       `json:"max children reached"`
+	SlowRequests       uint64       `json:"slow requests"`
+	Processes          []fpmProcess `json:"processes"`
+}
+
+type fpmProcess struct {
+	PID               int     `json:"pid"`
+	State             string  `json:"state"`
+	StartTime         int64   `json:"start time"`
+	Requests          uint64  `json:"requests"`
+	RequestDuration   int64   `json:"request duration"`
+	RequestMethod     string  `json:"request method"`
+	RequestURI        string  `json:"request uri"`
+	ContentLength     int64   `json:"content length"`
+	User              string  `json:"user"`
+	Script            string  `json:"script"`
+	LastRequestCPU    float64 `json:"last request cpu"`
+	LastRequestMemory uint64  `json:"last request memory"`
+}
+
+//Status fetches status page of the php-fpm pool at its pm.status_path, full status including the
+//processes is requested when full is set.
+func (c *Client) Status(ctx context.Context, path string, full bool) (*PoolStatus, error) {
+	query := "json"
+	if full {
+		query = "full&json"
+	}
+
+	status, body, err := c.Fetch(ctx, path+"?"+query)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != 200 {
+		return nil, fmt.Errorf("status page responded with status %d", status)
+	}
+
+	return ParseStatus(body)
+}
+
+//ParseStatus parses json output of php-fpm status page.
+func ParseStatus(body []byte) (*PoolStatus, error) {
+	var raw fpmStatus
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("malformed status page: %v", err)
+	}
+
+	ps := &PoolStatus{
+		Pool:               raw.Pool,
+		ProcessManager:     raw.ProcessManager,
+		StartTime:          time.Unix(raw.StartTime, 0),
+		AcceptedConns:      raw.AcceptedConn,
+		ListenQueue:        raw.ListenQueue,
+		MaxListenQueue:     raw.MaxListenQueue,
+		ListenQueueLen:     raw.ListenQueueLen,
+		IdleProcesses:      raw.IdleProcesses,
+		ActiveProcesses:    raw.ActiveProcesses,
+		TotalProcesses:     raw.TotalProcesses,
+		MaxActiveProcesses: raw.MaxActiveProcesses,
+		MaxChildrenReached: raw.MaxChildrenReached,
+		SlowRequests:       raw.SlowRequests,
+	}
+
+	for _, p := range raw.Processes {
+		ps.Processes = append(ps.Processes, ProcessStatus{
+			PID:               p.PID,
+			State:             strings.ToLower(p.State),
+			StartTime:         time.Unix(p.StartTime, 0),
+			Requests:          p.Requests,
+			RequestDuration:   time.Duration(p.RequestDuration) * time.Microsecond,
+			RequestMethod:     p.RequestMethod,
+			RequestURI:        p.RequestURI,
+			ContentLength:     p.ContentLength,
+			User:              p.User,
+			Script:            p.Script,
+			LastRequestCPU:    p.LastRequestCPU,
+			LastRequestMemory: p.LastRequestMemory,
+		})
+	}
+
+	return ps, nil
+}
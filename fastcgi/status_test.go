@@ -0,0 +1,39 @@
+package fastcgi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStatus(t *testing.T) {
+	body := `{"pool":"www","process manager":"dynamic","start time":1700000000,"start since":60,
+"accepted conn":42,"listen queue":3,"max listen queue":5,"listen queue len":128,"idle processes":1,
+"active processes":2,"total processes":3,"max active processes":3,"max children reached":7,"slow requests":1,
+"processes":[{"pid":101,"state":"Running","start time":1700000001,"start since":59,"requests":20,
+"request duration":1500,"request method":"GET","request uri":"/index.php?a=1","content length":0,
+"user":"-","script":"/app/index.php","last request cpu":12.5,"last request memory":2097152}]}`
+
+	ps, err := ParseStatus([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ps.Pool != "www" || ps.AcceptedConns != 42 || ps.ListenQueue != 3 || ps.ActiveProcesses != 2 ||
+		ps.MaxChildrenReached != 7 || !ps.StartTime.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("pool status %+v", ps)
+	}
+
+	if len(ps.Processes) != 1 {
+		t.Fatalf("processes %+v", ps.Processes)
+	}
+
+	p := ps.Processes[0]
+	if p.PID != 101 || p.State != "running" || p.RequestDuration != 1500*time.Microsecond ||
+		p.RequestURI != "/index.php?a=1" || p.LastRequestMemory != 2097152 {
+		t.Fatalf("process status %+v", p)
+	}
+
+	if _, err := ParseStatus([]byte("pool: www")); err == nil {
+		t.Fatal("plain text status is parsed")
+	}
+}
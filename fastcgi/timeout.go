@@ -0,0 +1,114 @@
+package fastcgi
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+//param holding seconds left until the request deadline, it is computed right before the request is
+//sent so it does not depend on the clock of the backend
+const deadlineParam = "REQUEST_DEADLINE"
+
+//Timeouts limit phases of the request, zero disables the limit. Connections shared by multiplexed
+//requests are only subject to Connect and Total as socket deadlines would affect other requests.
+type Timeouts struct {
+	//Connect limits dialing of the new connection.
+	Connect time.Duration
+
+	//Send limits sending of the params and stdin, request body is read from the client meanwhile.
+	Send time.Duration
+
+	//FirstByte limits the wait for the first record since the request started to be sent, so
+	//it includes sending of the body unless the body is buffered, see OptionBodyBuffer.
+	FirstByte time.Duration
+
+	//ReadIdle limits the wait between records of the response.
+	ReadIdle time.Duration
+
+	//Total limits the whole request including the wait for the connection, request is aborted
+	//when exceeded. Time left is passed to the application as REQUEST_DEADLINE.
+	Total time.Duration
+}
+
+//TimeoutError is reported when phase of the request did not complete in time.
+type TimeoutError struct {
+	//Phase which stalled: connect, send, first-byte, read-idle or total.
+	Phase string
+}
+
+func (e *TimeoutError) Error() string {
+	return "gofast: " + e.Phase + " timeout"
+}
+
+//Timeout reports error as timeout, same as net.Error.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+var (
+	//ErrConnectTimeout is reported when backend connection could not be opened in time.
+	ErrConnectTimeout = &TimeoutError{Phase: "connect"}
+
+	//ErrSendTimeout is reported when request could not be sent in time.
+	ErrSendTimeout = &TimeoutError{Phase: "send"}
+
+	//ErrFirstByteTimeout is reported when backend did not start to respond in time.
+	ErrFirstByteTimeout = &TimeoutError{Phase: "first-byte"}
+
+	//ErrReadIdleTimeout is reported when backend stalled in the middle of the response.
+	ErrReadIdleTimeout = &TimeoutError{Phase: "read-idle"}
+
+	//ErrTotalTimeout is reported when request did not complete in time.
+	ErrTotalTimeout = &TimeoutError{Phase: "total"}
+)
+
+//dialer limits dialing of the given dialer by the connect timeout.
+func (t Timeouts) dialer(dial Dialer) Dialer {
+	if t.Connect <= 0 {
+		return dial
+	}
+
+	return func(ctx context.Context) (net.Conn, error) {
+		dctx, cancel := context.WithTimeout(ctx, t.Connect)
+		defer cancel()
+
+		nc, err := dial(dctx)
+		if err != nil && dctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return nil, ErrConnectTimeout
+		}
+
+		return nc, err
+	}
+}
+
+//deadline returns the time request must complete by, zero when neither total timeout nor
+//context deadline is set.
+func (t Timeouts) deadline(ctx context.Context) time.Time {
+	deadline, ok := ctx.Deadline()
+	if t.Total <= 0 {
+		if !ok {
+			return time.Time{}
+		}
+
+		return deadline
+	}
+
+	if total := time.Now().Add(t.Total); !ok || total.Before(deadline) {
+		return total
+	}
+
+	return deadline
+}
+
+//formatRemaining formats time left until the deadline in seconds with milliseconds, deadline which
+//has passed already is reported as zero.
+func formatRemaining(deadline time.Time) string {
+	left := time.Until(deadline)
+	if left < 0 {
+		left = 0
+	}
+
+	return strconv.FormatFloat(left.Seconds(), 'f', 3, 64)
+}
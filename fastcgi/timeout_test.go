@@ -0,0 +1,245 @@
+package fastcgi
+
+import (
+	"bytes"
+	"context"
+	"fast-php/fastcgi/fastcgitest"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFirstByteTimeoutClearedByFirstRecord(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Stdout:     [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")},
+			Delay:      20 * time.Millisecond,
+			ChunkDelay: 100 * time.Millisecond,
+		}
+	})
+	defer srv.Close()
+
+	//response starts in time but takes longer than the first byte timeout, read idle is not limited
+	c := NewClient(srv.Dial, PoolConfig{}, OptionTimeouts(Timeouts{FirstByte: 150 * time.Millisecond}))
+	defer c.Close()
+
+	resp, err := c.Do(NewRequest(httptest.NewRequest("GET", "/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := resp.WriteTo(rec, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Code != 200 || rec.Body.String() != "abcd" {
+		t.Fatalf("status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRequestDeadlineParam(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{
+			Header: http.Header{"Content-Type": {"text/plain"}},
+			Stdout: [][]byte{[]byte(req.Params["REQUEST_DEADLINE"])},
+			Delay:  300 * time.Millisecond,
+		}
+	})
+	defer srv.Close()
+
+	c := NewClient(srv.Dial, PoolConfig{MaxOpen: 1}, OptionTimeouts(Timeouts{Total: 2 * time.Second}))
+	defer c.Close()
+
+	remaining := func() float64 {
+		resp, err := c.Do(NewRequest(httptest.NewRequest("GET", "/", nil)))
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+
+		rec := httptest.NewRecorder()
+		_ = resp.WriteTo(rec, ioutil.Discard)
+
+		left, err := strconv.ParseFloat(rec.Body.String(), 64)
+		if err != nil {
+			t.Error(err)
+		}
+
+		return left
+	}
+
+	//second request waits for the connection held by the first one
+	first := make(chan float64)
+	go func() {
+		first <- remaining()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	second := remaining()
+
+	if left := <-first; left <= 1.9 || left > 2 {
+		t.Fatalf("first request got %.3fs", left)
+	}
+
+	if second <= 1 || second >= 1.8 {
+		t.Fatalf("second request got %.3fs, time spent waiting for the connection was not deducted", second)
+	}
+}
+
+//slowWriter is client taking its time to receive every write.
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestTimeouts(t *testing.T) {
+	//backend which accepts the connection and never reads the request
+	deaf := func(ctx context.Context) (net.Conn, error) {
+		client, server := net.Pipe()
+		t.Cleanup(func() {
+			_ = server.Close()
+		})
+
+		return client, nil
+	}
+
+	//backend which never accepts the connection
+	unreachable := func(ctx context.Context) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	text := http.Header{"Content-Type": {"text/plain"}}
+
+	cases := []struct {
+		name     string
+		timeouts Timeouts
+		dial     Dialer
+		resp     *fastcgitest.Response
+		body     []byte
+		want     error
+		status   int
+
+		//delay of every write to the client
+		slow time.Duration
+	}{
+		{
+			name:     "connect",
+			timeouts: Timeouts{Connect: 50 * time.Millisecond},
+			dial:     unreachable,
+			want:     ErrConnectTimeout,
+		},
+		{
+			name:     "send",
+			timeouts: Timeouts{Send: 50 * time.Millisecond},
+			dial:     deaf,
+			body:     bytes.Repeat([]byte("x"), 1024),
+			want:     ErrSendTimeout,
+			status:   http.StatusGatewayTimeout,
+		},
+		{
+			name:     "first byte",
+			timeouts: Timeouts{FirstByte: 50 * time.Millisecond},
+			resp:     &fastcgitest.Response{Header: text, Stdout: [][]byte{[]byte("late")}, Delay: 300 * time.Millisecond},
+			want:     ErrFirstByteTimeout,
+			status:   http.StatusGatewayTimeout,
+		},
+		{
+			name:     "read idle",
+			timeouts: Timeouts{ReadIdle: 50 * time.Millisecond},
+			resp: &fastcgitest.Response{
+				Header:     text,
+				Stdout:     [][]byte{[]byte("a"), []byte("b")},
+				ChunkDelay: 300 * time.Millisecond,
+			},
+			want:   ErrReadIdleTimeout,
+			status: http.StatusOK,
+		},
+		{
+			name:     "slow client",
+			timeouts: Timeouts{ReadIdle: 50 * time.Millisecond},
+			resp: &fastcgitest.Response{
+				Header: text,
+				Stdout: [][]byte{bytes.Repeat([]byte("a"), 8000), bytes.Repeat([]byte("b"), 8000)},
+			},
+			status: http.StatusOK,
+			slow:   150 * time.Millisecond,
+		},
+		{
+			name:     "total",
+			timeouts: Timeouts{Total: 100 * time.Millisecond},
+			resp:     &fastcgitest.Response{Header: text, Stdout: [][]byte{[]byte("a")}, Fault: fastcgitest.FaultHang},
+			want:     ErrTotalTimeout,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "total without response",
+			timeouts: Timeouts{Total: 100 * time.Millisecond, ReadIdle: time.Second},
+			resp:     &fastcgitest.Response{Fault: fastcgitest.FaultHang},
+			want:     ErrTotalTimeout,
+			status:   http.StatusGatewayTimeout,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dial := c.dial
+			if dial == nil {
+				resp := c.resp
+				srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+					return resp
+				})
+				t.Cleanup(srv.Close)
+
+				dial = srv.Dial
+			}
+
+			client := NewClient(dial, PoolConfig{}, OptionTimeouts(c.timeouts), OptionAbortTimeout(50*time.Millisecond))
+			defer client.Close()
+
+			r := httptest.NewRequest("POST", "/", bytes.NewReader(c.body))
+			resp, err := client.Do(NewRequest(r))
+			if c.status == 0 {
+				if err != c.want {
+					t.Fatalf("error = %v, want %v", err, c.want)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			_ = resp.WriteTo(slowWriter{rec, c.slow}, ioutil.Discard)
+
+			if err := resp.Err(); err != c.want {
+				t.Fatalf("error = %v, want %v", err, c.want)
+			}
+
+			if rec.Code != c.status {
+				t.Fatalf("status = %d, want %d", rec.Code, c.status)
+			}
+
+			if c.slow > 0 && rec.Body.Len() != 16000 {
+				t.Fatalf("response truncated to %d bytes", rec.Body.Len())
+			}
+		})
+	}
+}
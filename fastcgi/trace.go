@@ -0,0 +1,207 @@
+package fastcgi
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//TraceText writes single human readable line per record.
+	TraceText = "text"
+
+	//TraceJSON writes single JSON object per record.
+	TraceJSON = "json"
+
+	//payload bytes written for stream records
+	defaultTracePayload = 256
+)
+
+const (
+	traceSend = "send"
+	traceRecv = "recv"
+)
+
+//Tracer dumps records of the traced requests as they go over the wire, see OptionTrace and
+//OptionTraceAll.
+type Tracer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	json bool
+
+	//MaxPayload limits bytes of stdin, stdout, stderr and data records written to the output,
+	//defaults to 256.
+	MaxPayload int
+}
+
+//traceEntry describes single record.
+type traceEntry struct {
+	Time          time.Time         `json:"time"`
+	Dir           string            `json:"dir"`
+	Type          string            `json:"type"`
+	ID            uint16            `json:"id"`
+	ContentLength uint16            `json:"content_length"`
+	PaddingLength uint8             `json:"padding_length"`
+	Params        Params            `json:"params,omitempty"`
+	Payload       *string           `json:"payload,omitempty"`
+	Truncated     bool              `json:"truncated,omitempty"`
+	Role          uint16            `json:"role,omitempty"`
+	Flags         *uint8            `json:"flags,omitempty"`
+	AppStatus     *uint32           `json:"app_status,omitempty"`
+	Status        *uint8            `json:"protocol_status,omitempty"`
+}
+
+//NewTracer creates tracer writing records in given format, TraceText or TraceJSON.
+func NewTracer(w io.Writer, format string) (*Tracer, error) {
+	if format != TraceText && format != TraceJSON {
+		return nil, fmt.Errorf("gofast: unknown trace format %q", format)
+	}
+
+	return &Tracer{
+		w:          w,
+		json:       format == TraceJSON,
+		MaxPayload: defaultTracePayload,
+	}, nil
+}
+
+//OpenTracer creates tracer appending records to the file.
+func OpenTracer(filename string, format string) (*Tracer, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := NewTracer(f, format)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+//Close closes the output when it is closable.
+func (t *Tracer) Close() error {
+	if c, ok := t.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+//OptionTrace traces records of the request.
+func OptionTrace(t *Tracer) OptionRequest {
+	return func(req *Request) {
+		req.Trace = t
+	}
+}
+
+//OptionTraceAll traces records of every request of the client which has no tracer of its own.
+func OptionTraceAll(t *Tracer) OptionClient {
+	return func(c *Client) {
+		c.trace = t
+	}
+}
+
+//record writes the record, errors of the output are ignored.
+func (t *Tracer) record(dir string, h *header, body []byte) {
+	e := &traceEntry{
+		Time:          time.Now(),
+		Dir:           dir,
+		Type:          h.Type.String(),
+		ID:            h.ID,
+		ContentLength: h.ContentLength,
+		PaddingLength: h.PaddingLength,
+	}
+
+	t.decode(e, h.Type, body)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.json {
+		_ = json.NewEncoder(t.w).Encode(e)
+		return
+	}
+
+	_, _ = io.WriteString(t.w, e.String()+"\n")
+}
+
+func (t *Tracer) decode(e *traceEntry, recType recType, body []byte) {
+	switch recType {
+		case typeBeginRequest:
+			if len(body) >= 3 {
+				flags := body[2]
+				e.Role, e.Flags = binary.BigEndian.Uint16(body), &flags
+			}
+
+		case typeEndRequest:
+			if end, err := readEndRequest(body); err == nil {
+				e.AppStatus, e.Status = &end.AppStatus, &end.ProtocolStatus
+			}
+
+		case typeParams, typeGetValues, typeGetValuesResult:
+			//pairs can be split between records, such records are dumped as payload. Pairs are kept
+			//in order, repeated names included
+			if params, err := parseParams(body); err == nil {
+				if len(params) != 0 {
+					e.Params = params
+				}
+
+				return
+			}
+
+			t.payload(e, body)
+
+		case typeStdin, typeStdout, typeStderr, typeData:
+			if len(body) != 0 {
+				t.payload(e, body)
+			}
+	}
+}
+
+func (t *Tracer) payload(e *traceEntry, body []byte) {
+	if t.MaxPayload >= 0 && len(body) > t.MaxPayload {
+		body, e.Truncated = body[:t.MaxPayload], true
+	}
+
+	payload := string(body)
+	e.Payload = &payload
+}
+
+//String formats the entry as single line, e.g.
+//2006-01-02T15:04:05.000Z07:00 send FCGI_PARAMS id=1 content=36 padding=4 SCRIPT_NAME="/index.php"
+func (e *traceEntry) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s %s %s id=%d content=%d padding=%d", e.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		e.Dir, e.Type, e.ID, e.ContentLength, e.PaddingLength)
+
+	if e.Flags != nil {
+		fmt.Fprintf(&b, " role=%d flags=%d", e.Role, *e.Flags)
+	}
+
+	if e.AppStatus != nil {
+		fmt.Fprintf(&b, " app_status=%d protocol_status=%d", *e.AppStatus, *e.Status)
+	}
+
+	for _, param := range e.Params {
+		fmt.Fprintf(&b, " %s=%s", param.Name, strconv.Quote(param.Value))
+	}
+
+	if e.Payload != nil {
+		fmt.Fprintf(&b, " payload=%s", strconv.Quote(*e.Payload))
+	}
+
+	if e.Truncated {
+		b.WriteString(" (truncated)")
+	}
+
+	return b.String()
+}
@@ -0,0 +1,217 @@
+package fastcgi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fast-php/fastcgi/fastcgitest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func traceServer(t *testing.T) *fastcgitest.Server {
+	srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{
+			Status: 200,
+			Header: http.Header{"Content-Type": {"text/plain"}},
+			Stdout: [][]byte{bytes.Repeat([]byte("x"), 20)},
+			Stderr: [][]byte{[]byte("warning")},
+		}
+	})
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestTracerText(t *testing.T) {
+	var out bytes.Buffer
+	tracer, err := NewTracer(&out, TraceText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracer.MaxPayload = 8
+
+	c := NewClient(traceServer(t).Dial, PoolConfig{}, OptionTraceAll(tracer))
+	defer c.Close()
+
+	if _, err := get(c, "/traced?a=1"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+
+	expected := []string{
+		"send FCGI_BEGIN_REQUEST id=1 content=8 padding=0 role=1 flags=1",
+		`send FCGI_PARAMS id=1`,
+		`REQUEST_URI="/traced?a=1"`,
+		"send FCGI_STDIN id=1 content=0",
+		`recv FCGI_STDERR id=1 content=7 padding=1 payload="warning"`,
+		`recv FCGI_STDOUT id=1`,
+		`payload="xxxxxxxx" (truncated)`,
+		"recv FCGI_END_REQUEST id=1 content=8 padding=0 app_status=0 protocol_status=0",
+	}
+
+	for _, want := range expected {
+		found := false
+		for _, line := range lines {
+			if strings.Contains(line, want) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			t.Fatalf("%q not traced in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestTracerJSON(t *testing.T) {
+	var out bytes.Buffer
+	tracer, err := NewTracer(&out, TraceJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(traceServer(t).Dial, PoolConfig{})
+	defer c.Close()
+
+	//only the request with tracer of its own is traced
+	if _, err := get(c, "/untraced"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.Do(NewRequest(httptest.NewRequest("GET", "/traced", nil), OptionTrace(tracer)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = resp.WriteTo(httptest.NewRecorder(), ioutil.Discard)
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var e traceEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Type == "FCGI_PARAMS" && e.Params != nil && e.Params.Get("REQUEST_URI") != "/traced" {
+			t.Fatalf("params of other request traced: %v", e.Params)
+		}
+
+		types = append(types, e.Dir+" "+e.Type)
+	}
+
+	if len(types) == 0 || types[0] != "send FCGI_BEGIN_REQUEST" || types[len(types)-1] != "recv FCGI_END_REQUEST" {
+		t.Fatalf("traced records %v", types)
+	}
+}
+
+func TestTracerParamsOrder(t *testing.T) {
+	for _, format := range []string{TraceText, TraceJSON} {
+		var out bytes.Buffer
+		tracer, err := NewTracer(&out, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := NewClient(traceServer(t).Dial, PoolConfig{}, OptionTraceAll(tracer))
+
+		req := NewRequest(httptest.NewRequest("GET", "/", nil))
+		req.AddParam("Z_FIRST", "1")
+		req.AddParam("A_REPEATED", "2")
+		req.AddParam("A_REPEATED", "3")
+
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = resp.WriteTo(httptest.NewRecorder(), ioutil.Discard)
+		_ = c.Close()
+
+		if format == TraceText {
+			if !strings.Contains(out.String(), `Z_FIRST="1" A_REPEATED="2" A_REPEATED="3"`) {
+				t.Fatalf("params reordered or folded in\n%s", out.String())
+			}
+
+			continue
+		}
+
+		var params Params
+		dec := json.NewDecoder(&out)
+		for dec.More() {
+			var e traceEntry
+			if err := dec.Decode(&e); err != nil {
+				t.Fatal(err)
+			}
+
+			params = append(params, e.Params...)
+		}
+
+		want := Params{{"Z_FIRST", "1"}, {"A_REPEATED", "2"}, {"A_REPEATED", "3"}}
+		if n := len(params); n < 3 || !reflect.DeepEqual(params[n-3:], want) {
+			t.Fatalf("traced params %v", params)
+		}
+	}
+}
+
+func TestBackendTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var servers []*fastcgitest.Server
+	for i := 0; i < 2; i++ {
+		srv := fastcgitest.NewServer(nil)
+		defer srv.Close()
+
+		servers = append(servers, srv)
+	}
+
+	file := filepath.Join(dir, "a.log")
+	cfg := &UpstreamConfig{Backends: []BackendConfig{
+		{Address: servers[0].Address(), Trace: file, TraceFormat: TraceJSON},
+		{Address: servers[1].Address()},
+	}}
+
+	u, err := DialUpstream(cfg, PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//round-robin passes one request to each backend
+	for i := 0; i < 2; i++ {
+		serve(t, u, httptest.NewRequest("GET", "/", nil))
+	}
+
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(string(out), `"type":"FCGI_BEGIN_REQUEST"`); n != 1 {
+		t.Fatalf("%d requests traced for the backend:\n%s", n, out)
+	}
+
+	cfg.Backends[1].TraceFormat = "xml"
+	if _, err := DialUpstream(cfg, PoolConfig{}); err == nil {
+		t.Fatal("unknown trace format accepted")
+	}
+}
@@ -0,0 +1,834 @@
+package fastcgi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	//StrategyRoundRobin passes requests to the backends in turn, weights are ignored.
+	StrategyRoundRobin = "round-robin"
+
+	//StrategyWeighted passes requests to the backends in turn in proportion to their weights.
+	StrategyWeighted = "weighted"
+
+	//StrategyLeastInFlight passes requests to the backend with the least requests in flight
+	//relative to its weight.
+	StrategyLeastInFlight = "least-in-flight"
+
+	//StrategyHash maps client IP, or the configured header, onto the backend using consistent
+	//hashing, so only the keys of the failed backend move elsewhere.
+	StrategyHash = "hash"
+)
+
+const (
+	defaultFailTimeout = 10 * time.Second
+
+	//points of the hash ring per unit of weight
+	hashPoints = 160
+)
+
+//ErrNoBackend is returned by Upstream.Do when all backends are unavailable.
+var ErrNoBackend = errors.New("gofast: no backend available")
+
+//BackendConfig describes single backend of the upstream group.
+type BackendConfig struct {
+	//Address of the backend, see NewDialer.
+	Address string
+
+	//Weight of the backend, defaults to 1.
+	Weight int
+
+	//MaxFails failures within FailTimeout make the backend unavailable for FailTimeout, defaults
+	//to 1. Negative value disables the tracking.
+	MaxFails int
+
+	//FailTimeout defaults to 10 seconds.
+	FailTimeout time.Duration
+
+	//PingPath is ping.path of the php-fpm pool used by the active health checks, the path of the
+	//health check config is used when empty.
+	PingPath string
+
+	//Trace is the file records of every request of the backend are appended to, it replaces the
+	//tracer given to DialUpstream. Disabled when empty.
+	Trace string
+
+	//TraceFormat is TraceText or TraceJSON, defaults to text.
+	TraceFormat string
+}
+
+//UpstreamConfig configures group of the backends.
+type UpstreamConfig struct {
+	//Strategy picking the backend of the request, defaults to round-robin.
+	Strategy string
+
+	//HashHeader keys hash strategy by the request header instead of client IP, requests without
+	//the header are keyed by client IP.
+	HashHeader string
+
+	//Backends of the group.
+	Backends []BackendConfig
+
+	//Retry sends requests which failed before any output to the next backend, see RetryConfig.
+	//Disabled when nil.
+	Retry *RetryConfig
+
+	//Breaker adds circuit breaker to every backend, see BreakerConfig. Disabled when nil.
+	Breaker *BreakerConfig
+}
+
+const (
+	//RetryConnect retries requests when connection to the backend could not be opened.
+	RetryConnect = "connect"
+
+	//RetryReset retries requests when connection was closed or reset before any output.
+	RetryReset = "reset"
+
+	//RetryOverloaded retries requests rejected by the backend with FCGI_OVERLOADED.
+	RetryOverloaded = "overloaded"
+
+	//RetryTimeout retries requests which timed out connecting or waiting for the first byte.
+	RetryTimeout = "timeout"
+)
+
+//RetryConfig configures retries of the requests on the next backend. Request is only retried
+//until the backend sends any stdout or stderr, so nothing has been passed to the client yet, and
+//every backend is tried once at most. Request body must be buffered to be sent again, see
+//OptionBodyBuffer, requests with unbuffered body are only retried when connection failed.
+type RetryConfig struct {
+	//On lists the failures retried, defaults to connect, reset and overloaded.
+	On []string
+
+	//Tries limits attempts of the request including the first one, zero tries every backend.
+	Tries int
+
+	//Timeout limits time since the first attempt new attempts can be started in, zero means no
+	//limit.
+	Timeout time.Duration
+
+	//NonIdempotent retries requests of any method, only GET, HEAD, OPTIONS, TRACE, PUT and
+	//DELETE requests are retried by default.
+	NonIdempotent bool
+}
+
+//Valid validates the configuration.
+func (cfg *RetryConfig) Valid() error {
+	if cfg.Tries < 0 || cfg.Timeout < 0 {
+		return errors.New("gofast: invalid retry limits")
+	}
+
+	for _, class := range cfg.On {
+		switch class {
+			case RetryConnect, RetryReset, RetryOverloaded, RetryTimeout:
+
+			default:
+				return fmt.Errorf("gofast: unknown retry condition %q", class)
+		}
+	}
+
+	return nil
+}
+
+//retries reports whether failure of given class is retried.
+func (cfg *RetryConfig) retries(class string) bool {
+	if class == "" {
+		return false
+	}
+
+	if len(cfg.On) == 0 {
+		return class != RetryTimeout
+	}
+
+	for _, c := range cfg.On {
+		if c == class {
+			return true
+		}
+	}
+
+	return false
+}
+
+//allows reports whether method of the request can be retried.
+func (cfg *RetryConfig) allows(req *Request) bool {
+	if cfg.NonIdempotent {
+		return true
+	}
+
+	switch req.Param("REQUEST_METHOD") {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+			return true
+
+		default:
+			return false
+	}
+}
+
+//Valid validates the configuration.
+func (cfg *UpstreamConfig) Valid() error {
+	if err := validStrategy(cfg.Strategy); err != nil {
+		return err
+	}
+
+	if len(cfg.Backends) == 0 {
+		return errors.New("gofast: upstream has no backends")
+	}
+
+	for _, b := range cfg.Backends {
+		if b.Weight < 0 || b.FailTimeout < 0 {
+			return fmt.Errorf("gofast: invalid backend %q", b.Address)
+		}
+
+		if b.TraceFormat != "" && b.TraceFormat != TraceText && b.TraceFormat != TraceJSON {
+			return fmt.Errorf("gofast: unknown trace format %q of backend %q", b.TraceFormat, b.Address)
+		}
+	}
+
+	if cfg.Retry != nil {
+		if err := cfg.Retry.Valid(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Breaker != nil {
+		return cfg.Breaker.Valid()
+	}
+
+	return nil
+}
+
+func validStrategy(strategy string) error {
+	switch strategy {
+		case "", StrategyRoundRobin, StrategyWeighted, StrategyLeastInFlight, StrategyHash:
+			return nil
+
+		default:
+			return fmt.Errorf("gofast: unknown upstream strategy %q", strategy)
+	}
+}
+
+//Backend is member of the upstream group, it tracks requests in flight and failures of the client.
+type Backend struct {
+	client *Client
+	cfg    BackendConfig
+
+	inflight int64
+
+	mu        sync.Mutex
+	fails     int
+	checked   time.Time
+	downUntil time.Time
+
+	//set by the active health checks
+	down bool
+
+	//set when the upstream has breaker configured
+	breaker *breaker
+
+	//tracer of BackendConfig.Trace opened by DialUpstream, closed along with the upstream
+	tracer *Tracer
+
+	//current weight of the weighted strategy, guarded by the upstream
+	current int
+}
+
+//NewBackend wraps the client into the backend.
+func NewBackend(client *Client, cfg BackendConfig) *Backend {
+	if cfg.Weight == 0 {
+		cfg.Weight = 1
+	}
+
+	if cfg.MaxFails == 0 {
+		cfg.MaxFails = 1
+	}
+
+	if cfg.FailTimeout == 0 {
+		cfg.FailTimeout = defaultFailTimeout
+	}
+
+	return &Backend{client: client, cfg: cfg}
+}
+
+//Name returns name of the backend client, see OptionName.
+func (b *Backend) Name() string {
+	return b.client.name
+}
+
+//Config returns configuration of the backend with the defaults applied.
+func (b *Backend) Config() BackendConfig {
+	return b.cfg
+}
+
+//Client returns client of the backend.
+func (b *Backend) Client() *Client {
+	return b.client
+}
+
+//InFlight returns amount of requests being served by the backend.
+func (b *Backend) InFlight() int64 {
+	return atomic.LoadInt64(&b.inflight)
+}
+
+//Available reports whether backend accepts requests, backend is unavailable for FailTimeout once
+//it failed MaxFails times and while it is marked down.
+func (b *Backend) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.down || time.Now().Before(b.downUntil) {
+		return false
+	}
+
+	return b.breaker == nil || b.breaker.ready()
+}
+
+//Breaker returns state of the circuit breaker and how many times it opened, breaker of the
+//backend without one is always closed.
+func (b *Backend) Breaker() (BreakerState, uint64) {
+	if b.breaker == nil {
+		return BreakerClosed, 0
+	}
+
+	return b.breaker.stats()
+}
+
+//Healthy reports whether backend has not been marked down.
+func (b *Backend) Healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !b.down
+}
+
+//SetHealthy marks the backend up or down, it reports whether the state has changed.
+func (b *Backend) SetHealthy(healthy bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	changed := b.down == healthy
+	b.down = !healthy
+
+	return changed
+}
+
+//report records outcome of the request, failures are counted within FailTimeout of the first one.
+func (b *Backend) report(failed bool) {
+	if b.cfg.MaxFails < 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.fails = 0
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(b.checked) > b.cfg.FailTimeout {
+		b.fails, b.checked = 0, now
+	}
+
+	if b.fails++; b.fails >= b.cfg.MaxFails {
+		b.fails, b.downUntil = 0, now.Add(b.cfg.FailTimeout)
+	}
+}
+
+//done records outcome of the request, requests failed because of the client are not counted by
+//the breaker.
+func (b *Backend) done(probe bool, err error, end *EndRequest, elapsed time.Duration) {
+	failed := backendFailed(err, end)
+	b.report(failed)
+
+	if b.breaker != nil {
+		b.breaker.done(probe, !clientFailed(err), failed, elapsed)
+	}
+}
+
+//Upstream passes requests to the group of backends.
+type Upstream struct {
+	cfg      UpstreamConfig
+	backends []*Backend
+
+	mu   sync.Mutex
+	next int
+
+	//notified about state changes of the breakers, see OnBreaker
+	onBreaker func(b *Backend, state BreakerState)
+
+	//sorted points of the hash ring and their backends
+	points []uint32
+	owners map[uint32]*Backend
+}
+
+//NewUpstream creates group of the backends, see DialUpstream.
+func NewUpstream(cfg *UpstreamConfig, backends ...*Backend) (*Upstream, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("gofast: upstream has no backends")
+	}
+
+	if err := validStrategy(cfg.Strategy); err != nil {
+		return nil, err
+	}
+
+	if cfg.Retry != nil {
+		if err := cfg.Retry.Valid(); err != nil {
+			return nil, err
+		}
+	}
+
+	u := &Upstream{cfg: *cfg, backends: backends}
+
+	if cfg.Breaker != nil {
+		bc := *cfg.Breaker
+		if err := bc.Valid(); err != nil {
+			return nil, err
+		}
+
+		_ = bc.InitDefaults()
+		u.cfg.Breaker = &bc
+
+		for _, b := range backends {
+			b := b
+			b.breaker = newBreaker(u.cfg.Breaker, func(state BreakerState) {
+				u.breakerChanged(b, state)
+			})
+		}
+	}
+
+	if u.cfg.Strategy == StrategyHash {
+		u.ring()
+	}
+
+	return u, nil
+}
+
+//DialUpstream creates group of the configured backends, clients are created by NewClient with
+//the pool config and options, named after the backend address. Backends with Trace get tracers
+//of their own.
+func DialUpstream(cfg *UpstreamConfig, pool PoolConfig, opts ...OptionClient) (*Upstream, error) {
+	if err := cfg.Valid(); err != nil {
+		return nil, err
+	}
+
+	var backends []*Backend
+	closeTracers := func() {
+		for _, b := range backends {
+			if b.tracer != nil {
+				_ = b.tracer.Close()
+			}
+		}
+	}
+
+	for _, bc := range cfg.Backends {
+		dialer, err := NewDialer(bc.Address)
+		if err != nil {
+			closeTracers()
+			return nil, err
+		}
+
+		bopts := append(opts[:len(opts):len(opts)], OptionName(bc.Address))
+
+		var tracer *Tracer
+		if bc.Trace != "" {
+			format := bc.TraceFormat
+			if format == "" {
+				format = TraceText
+			}
+
+			if tracer, err = OpenTracer(bc.Trace, format); err != nil {
+				closeTracers()
+				return nil, err
+			}
+
+			bopts = append(bopts, OptionTraceAll(tracer))
+		}
+
+		b := NewBackend(NewClient(dialer, pool, bopts...), bc)
+		b.tracer = tracer
+		backends = append(backends, b)
+	}
+
+	u, err := NewUpstream(cfg, backends...)
+	if err != nil {
+		closeTracers()
+	}
+
+	return u, err
+}
+
+//Backends returns backends of the group.
+func (u *Upstream) Backends() []*Backend {
+	return u.backends
+}
+
+//Breaker returns configuration of the circuit breakers with the defaults applied, nil when
+//there are none.
+func (u *Upstream) Breaker() *BreakerConfig {
+	return u.cfg.Breaker
+}
+
+//OnBreaker sets function called whenever circuit breaker of the backend changes its state.
+func (u *Upstream) OnBreaker(fn func(b *Backend, state BreakerState)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.onBreaker = fn
+}
+
+func (u *Upstream) breakerChanged(b *Backend, state BreakerState) {
+	u.mu.Lock()
+	fn := u.onBreaker
+	u.mu.Unlock()
+
+	if fn != nil {
+		fn(b, state)
+	}
+}
+
+//Close closes clients of the backends and tracers opened for them.
+func (u *Upstream) Close() error {
+	var err error
+	for _, b := range u.backends {
+		if e := b.client.Close(); e != nil && err == nil {
+			err = e
+		}
+
+		if b.tracer != nil {
+			_ = b.tracer.Close()
+		}
+	}
+
+	return err
+}
+
+//Do sends request to the backend picked by the strategy. Failures of the backend are recorded
+//once the request is complete, requests aborted by the client are not counted. Request is sent to
+//the next backend on failures configured by UpstreamConfig.Retry.
+func (u *Upstream) Do(req *Request) (*ResponsePipe, error) {
+	if u.cfg.Retry != nil && u.cfg.Retry.allows(req) {
+		return u.retry(req)
+	}
+
+	//breaker might have rejected the request since the backend was picked
+	tried := make(map[*Backend]bool)
+	for {
+		b := u.pick(req, tried)
+		if b == nil {
+			return nil, ErrNoBackend
+		}
+
+		resp, err := u.send(b, req)
+		if err != ErrCircuitOpen {
+			return resp, err
+		}
+
+		tried[b] = true
+	}
+}
+
+//retry sends request to the backends in turn until one of them starts to respond or fails in the
+//way which is not retried. Response of the last attempt is returned once the tries are exhausted.
+func (u *Upstream) retry(req *Request) (resp *ResponsePipe, err error) {
+	cfg := u.cfg.Retry
+
+	//body is spooled once so every attempt sends it from the start
+	if req.BodyBuffer != nil && req.Stdin != nil && req.body == nil {
+		if err = req.spool(); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.body != nil {
+		body := req.body
+		defer func() {
+			if resp == nil {
+				body.remove()
+				return
+			}
+
+			resp.onFinish(func(error) {
+				body.remove()
+			})
+		}()
+	}
+
+	start := time.Now()
+	tried := make(map[*Backend]bool)
+
+	for {
+		b := u.pick(req, tried)
+		if b == nil {
+			if len(tried) == 0 {
+				return nil, ErrNoBackend
+			}
+
+			return
+		}
+
+		tried[b] = true
+		if resp, err = u.send(b, req); err == ErrCircuitOpen {
+			continue
+		}
+
+		var class string
+		if err != nil {
+			class = retryClass(err, nil)
+		} else if !resp.started() {
+			class = retryClass(resp.Err(), resp.EndRequest())
+		}
+
+		//body which has been read might not be sent again
+		if class != RetryConnect && !req.resendable() {
+			class = ""
+		}
+
+		if !cfg.retries(class) || cfg.Tries > 0 && len(tried) >= cfg.Tries ||
+			cfg.Timeout > 0 && time.Since(start) >= cfg.Timeout {
+			return
+		}
+
+		if resp != nil && resp.buffer != nil {
+			resp.buffer.remove()
+		}
+	}
+}
+
+//retryClass returns class of the failure which happened before any output, empty when the
+//failure is not retried.
+func retryClass(err error, end *EndRequest) string {
+	if err == nil {
+		if end != nil && end.Err() == ErrOverloaded {
+			return RetryOverloaded
+		}
+
+		return ""
+	}
+
+	//resets of the client connection must not be taken for resets of the backend
+	if clientFailed(err) {
+		return ""
+	}
+
+	if err == ErrConnectTimeout || err == ErrFirstByteTimeout {
+		return RetryTimeout
+	}
+
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		return RetryConnect
+	}
+
+	if err == errConnClosed || err == io.ErrClosedPipe || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return RetryReset
+	}
+
+	return ""
+}
+
+//send sends request to the backend, counting it in flight until it is complete. Outcome is
+//recorded by the breaker of the backend, ErrCircuitOpen is returned when the breaker rejected it.
+//Latency is measured to the first output so slow clients do not make the backend look slow.
+func (u *Upstream) send(b *Backend, req *Request) (*ResponsePipe, error) {
+	var probe bool
+	if b.breaker != nil {
+		var ok bool
+		if ok, probe = b.breaker.acquire(); !ok {
+			return nil, ErrCircuitOpen
+		}
+	}
+
+	start := time.Now()
+	atomic.AddInt64(&b.inflight, 1)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		atomic.AddInt64(&b.inflight, -1)
+		b.done(probe, err, nil, time.Since(start))
+
+		return nil, err
+	}
+
+	resp.onFinish(func(err error) {
+		atomic.AddInt64(&b.inflight, -1)
+
+		elapsed := time.Since(start)
+		if first := resp.firstByte(); !first.IsZero() {
+			elapsed = first.Sub(start)
+		}
+
+		b.done(probe, err, resp.EndRequest(), elapsed)
+	})
+
+	return resp, nil
+}
+
+//backendFailed tells failures of the backend from the failures caused by the client.
+func backendFailed(err error, end *EndRequest) bool {
+	if err == nil {
+		return end != nil && end.Err() == ErrOverloaded
+	}
+
+	return !clientFailed(err)
+}
+
+//clientFailed reports failures caused by the client, they count neither as failures of the
+//backend nor as requests of its breaker.
+func clientFailed(err error) bool {
+	switch err.(type) {
+		case *AbortError, *BodyError:
+			return true
+	}
+
+	return err == context.Canceled || err == context.DeadlineExceeded || err == ErrStreamStalled ||
+		err == ErrBodyTooLarge
+}
+
+//pick returns available backend of the request which has not been tried yet, nil when there is none.
+func (u *Upstream) pick(req *Request, tried map[*Backend]bool) *Backend {
+	available := make([]*Backend, 0, len(u.backends))
+	for _, b := range u.backends {
+		if b.Available() && !tried[b] {
+			available = append(available, b)
+		}
+	}
+
+	if len(available) == 0 {
+		return nil
+	}
+
+	switch u.cfg.Strategy {
+		case StrategyWeighted:
+			return u.weighted(available)
+
+		case StrategyLeastInFlight:
+			return leastInFlight(available)
+
+		case StrategyHash:
+			return u.hash(u.key(req), tried)
+
+		default:
+			u.mu.Lock()
+			defer u.mu.Unlock()
+
+			b := available[u.next%len(available)]
+			u.next++
+
+			return b
+	}
+}
+
+//weighted implements smooth weighted round-robin, as nginx does.
+func (u *Upstream) weighted(available []*Backend) *Backend {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var (
+		best  *Backend
+		total int
+	)
+
+	for _, b := range available {
+		b.current += b.cfg.Weight
+		total += b.cfg.Weight
+
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+
+	best.current -= total
+
+	return best
+}
+
+func leastInFlight(available []*Backend) *Backend {
+	best := available[0]
+	for _, b := range available[1:] {
+		//compares inflight/weight without division
+		if b.InFlight()*int64(best.cfg.Weight) < best.InFlight()*int64(b.cfg.Weight) {
+			best = b
+		}
+	}
+
+	return best
+}
+
+//key returns hash key of the request, the header when configured and present or client IP.
+func (u *Upstream) key(req *Request) string {
+	if u.cfg.HashHeader != "" && req.Raw != nil {
+		if value := req.Raw.Header.Get(u.cfg.HashHeader); value != "" {
+			return value
+		}
+	}
+
+	//REMOTE_ADDR is the real client address when request came through trusted proxy
+	if addr := req.Param("REMOTE_ADDR"); addr != "" {
+		return addr
+	}
+
+	if req.Raw != nil {
+		if host, _, err := net.SplitHostPort(req.Raw.RemoteAddr); err == nil {
+			return host
+		}
+
+		return req.Raw.RemoteAddr
+	}
+
+	return ""
+}
+
+//ring places points of every backend on the hash ring in proportion to its weight.
+func (u *Upstream) ring() {
+	u.owners = make(map[uint32]*Backend)
+
+	for n, b := range u.backends {
+		//points follow the backend when the backends are reordered
+		id := b.cfg.Address
+		if id == "" {
+			id = strconv.Itoa(n)
+		}
+
+		for i := 0; i < hashPoints*b.cfg.Weight; i++ {
+			point := crc32.ChecksumIEEE([]byte(id + "-" + strconv.Itoa(i)))
+			if _, ok := u.owners[point]; ok {
+				continue
+			}
+
+			u.owners[point] = b
+			u.points = append(u.points, point)
+		}
+	}
+
+	sort.Slice(u.points, func(i, j int) bool {
+		return u.points[i] < u.points[j]
+	})
+}
+
+//hash returns owner of the key, unavailable and tried backends are skipped clockwise.
+func (u *Upstream) hash(key string, tried map[*Backend]bool) *Backend {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(u.points), func(i int) bool {
+		return u.points[i] >= h
+	})
+
+	for n := 0; n < len(u.points); n++ {
+		if b := u.owners[u.points[(i+n)%len(u.points)]]; b.Available() && !tried[b] {
+			return b
+		}
+	}
+
+	return nil
+}
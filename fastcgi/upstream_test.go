@@ -0,0 +1,432 @@
+package fastcgi
+
+import (
+	"context"
+	"fast-php/fastcgi/fastcgitest"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//testUpstream creates upstream over fake backends named a, b, c...
+func testUpstream(t *testing.T, cfg *UpstreamConfig, handlers ...fastcgitest.Handler) *Upstream {
+	var backends []*Backend
+	for i, h := range handlers {
+		srv := fastcgitest.NewPipeServer(h)
+		t.Cleanup(srv.Close)
+
+		name := string(rune('a' + i))
+		bc := BackendConfig{Address: name}
+		if len(cfg.Backends) > i {
+			bc = cfg.Backends[i]
+			bc.Address = name
+		}
+
+		backends = append(backends, NewBackend(NewClient(srv.Dial, PoolConfig{}, OptionName(name)), bc))
+	}
+
+	u, err := NewUpstream(cfg, backends...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = u.Close()
+	})
+
+	return u
+}
+
+func okHandler(req *fastcgitest.Request) *fastcgitest.Response {
+	return &fastcgitest.Response{Status: 200, Header: http.Header{"Content-Type": {"text/plain"}}}
+}
+
+//serve sends request and returns name of the backend which served it.
+func serve(t *testing.T, u *Upstream, r *http.Request) string {
+	t.Helper()
+
+	resp, err := u.Do(NewRequest(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = resp.WriteTo(httptest.NewRecorder(), ioutil.Discard)
+	_ = resp.Err()
+
+	return resp.Backend()
+}
+
+func sequence(t *testing.T, u *Upstream, n int) string {
+	var seq string
+	for i := 0; i < n; i++ {
+		seq += serve(t, u, httptest.NewRequest("GET", "/", nil))
+	}
+
+	return seq
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	u := testUpstream(t, &UpstreamConfig{}, okHandler, okHandler, okHandler)
+
+	//first request goes to the first backend
+	if seq := sequence(t, u, 6); seq != "abcabc" {
+		t.Fatalf("sequence = %s", seq)
+	}
+}
+
+func TestUpstreamWeighted(t *testing.T) {
+	cfg := &UpstreamConfig{
+		Strategy: StrategyWeighted,
+		Backends: []BackendConfig{{Weight: 5}, {Weight: 1}, {Weight: 1}},
+	}
+
+	u := testUpstream(t, cfg, okHandler, okHandler, okHandler)
+
+	//smooth weighted round-robin of nginx
+	if seq := sequence(t, u, 7); seq != "aabacaa" {
+		t.Fatalf("sequence = %s", seq)
+	}
+}
+
+func TestUpstreamLeastInFlight(t *testing.T) {
+	release := make(chan struct{})
+	slow := func(req *fastcgitest.Request) *fastcgitest.Response {
+		<-release
+		return okHandler(req)
+	}
+
+	u := testUpstream(t, &UpstreamConfig{Strategy: StrategyLeastInFlight}, slow, okHandler)
+
+	//first request keeps a busy
+	resp, err := u.Do(NewRequest(httptest.NewRequest("GET", "/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Backend() != "a" {
+		t.Fatalf("first request served by %s", resp.Backend())
+	}
+
+	if seq := sequence(t, u, 3); seq != "bbb" {
+		t.Fatalf("sequence = %s", seq)
+	}
+
+	close(release)
+	_ = resp.WriteTo(httptest.NewRecorder(), ioutil.Discard)
+	_ = resp.Err()
+}
+
+func TestUpstreamHash(t *testing.T) {
+	handlers := []fastcgitest.Handler{okHandler, okHandler, okHandler}
+	u := testUpstream(t, &UpstreamConfig{Strategy: StrategyHash, HashHeader: "X-Session"}, handlers...)
+
+	owners := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i)
+
+		owners[r.RemoteAddr] = serve(t, u, r)
+		if again := serve(t, u, r); again != owners[r.RemoteAddr] {
+			t.Fatalf("%s served by %s and %s", r.RemoteAddr, owners[r.RemoteAddr], again)
+		}
+	}
+
+	used := make(map[string]bool)
+	for _, owner := range owners {
+		used[owner] = true
+	}
+
+	if len(used) != 3 {
+		t.Fatalf("keys spread over %d backends", len(used))
+	}
+
+	//header takes precedence over client IP
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Session", "abc")
+	owner := serve(t, u, r)
+
+	for i := 0; i < 5; i++ {
+		r.RemoteAddr = fmt.Sprintf("10.0.1.%d:1234", i)
+		if got := serve(t, u, r); got != owner {
+			t.Fatalf("session served by %s and %s", owner, got)
+		}
+	}
+
+	//keys of the unavailable backend move, other keys stay
+	u.backends[0].downUntil = time.Now().Add(time.Minute)
+	for addr, prev := range owners {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+
+		got := serve(t, u, r)
+		if got == "a" || prev != "a" && got != prev {
+			t.Fatalf("%s moved from %s to %s", addr, prev, got)
+		}
+	}
+}
+
+func TestUpstreamPassiveHealth(t *testing.T) {
+	failing := func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{Fault: fastcgitest.FaultClose}
+	}
+
+	cfg := &UpstreamConfig{
+		Backends: []BackendConfig{{MaxFails: 2, FailTimeout: 200 * time.Millisecond}, {MaxFails: -1}},
+	}
+
+	u := testUpstream(t, cfg, failing, okHandler)
+	a := u.backends[0]
+
+	if seq := sequence(t, u, 4); seq != "abab" {
+		t.Fatalf("sequence = %s", seq)
+	}
+
+	if a.Available() {
+		t.Fatal("backend available after 2 failures")
+	}
+
+	if seq := sequence(t, u, 3); seq != "bbb" {
+		t.Fatalf("sequence = %s", seq)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if !a.Available() {
+		t.Fatal("backend unavailable after fail timeout")
+	}
+}
+
+func TestUpstreamNoBackend(t *testing.T) {
+	u := testUpstream(t, &UpstreamConfig{}, okHandler)
+	u.backends[0].downUntil = time.Now().Add(time.Minute)
+
+	if _, err := u.Do(NewRequest(httptest.NewRequest("GET", "/", nil))); err != ErrNoBackend {
+		t.Fatalf("error = %v", err)
+	}
+}
+
+//failingBody fails the upload as client going away would.
+type failingBody struct{}
+
+func (failingBody) Read(p []byte) (int, error) {
+	return 0, syscall.ECONNRESET
+}
+
+func TestUpstreamClientFailures(t *testing.T) {
+	cfg := &UpstreamConfig{
+		Breaker:  &BreakerConfig{MinRequests: 1, OpenTimeout: time.Minute},
+		Backends: []BackendConfig{{MaxFails: 1, FailTimeout: time.Minute}},
+	}
+
+	u := testUpstream(t, cfg, okHandler)
+	a := u.backends[0]
+
+	//body is larger than the buffer allows, 413 is sent to the client
+	r := httptest.NewRequest("POST", "/", strings.NewReader("hello"))
+	if _, err := u.Do(NewRequest(r, OptionBodyBuffer(&BodyBuffer{MaxSize: 4}))); err != ErrBodyTooLarge {
+		t.Fatalf("error = %v", err)
+	}
+
+	//client goes away while the body is buffered or sent
+	r = httptest.NewRequest("POST", "/", failingBody{})
+	if _, err := u.Do(NewRequest(r, OptionBodyBuffer(&BodyBuffer{}))); err == nil {
+		t.Fatal("failed body was buffered")
+	}
+
+	r = httptest.NewRequest("POST", "/", failingBody{})
+	resp, err := u.Do(NewRequest(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = resp.WriteTo(httptest.NewRecorder(), ioutil.Discard)
+	if _, ok := resp.Err().(*BodyError); !ok {
+		t.Fatalf("error = %v", resp.Err())
+	}
+
+	if !a.Available() {
+		t.Fatal("backend marked down by failures of the client")
+	}
+
+	if state, trips := a.Breaker(); state != BreakerClosed || trips != 0 {
+		t.Fatalf("breaker %s after %d trips", state, trips)
+	}
+
+	if seq := sequence(t, u, 1); seq != "a" {
+		t.Fatalf("sequence = %s", seq)
+	}
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	closing := func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{Fault: fastcgitest.FaultClose}
+	}
+
+	overloaded := func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{ProtocolStatus: 2}
+	}
+
+	//output has been passed to the client before the connection is closed
+	partial := func(req *fastcgitest.Request) *fastcgitest.Response {
+		resp := okHandler(req)
+		resp.Fault = fastcgitest.FaultClose
+
+		return resp
+	}
+
+	echo := func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{
+			Header: http.Header{"Content-Type": {"text/plain"}},
+			Stdout: [][]byte{req.Stdin},
+		}
+	}
+
+	cases := []struct {
+		name    string
+		retry   *RetryConfig
+		failing fastcgitest.Handler
+		method  string
+		buffer  bool
+		backend string
+	}{
+		{name: "reset", retry: &RetryConfig{}, failing: closing, method: "GET", backend: "b"},
+		{name: "overloaded", retry: &RetryConfig{}, failing: overloaded, method: "GET", backend: "b"},
+		{name: "started", retry: &RetryConfig{}, failing: partial, method: "GET", backend: "a"},
+		{name: "disabled class", retry: &RetryConfig{On: []string{RetryConnect}}, failing: closing, method: "GET", backend: "a"},
+		{name: "single try", retry: &RetryConfig{Tries: 1}, failing: closing, method: "GET", backend: "a"},
+		{name: "non idempotent", retry: &RetryConfig{}, failing: closing, method: "POST", buffer: true, backend: "a"},
+		{name: "unbuffered body", retry: &RetryConfig{NonIdempotent: true}, failing: closing, method: "POST", backend: "a"},
+		{name: "buffered body", retry: &RetryConfig{NonIdempotent: true}, failing: closing, method: "POST", buffer: true, backend: "b"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &UpstreamConfig{Retry: c.retry, Backends: []BackendConfig{{MaxFails: -1}, {MaxFails: -1}}}
+
+			//round-robin starts at a
+			u := testUpstream(t, cfg, c.failing, echo)
+
+			var opts []OptionRequest
+			if c.buffer {
+				opts = append(opts, OptionBodyBuffer(&BodyBuffer{Memory: 4}))
+			}
+
+			r := httptest.NewRequest(c.method, "/", strings.NewReader("hello"))
+			if c.method == "GET" {
+				r = httptest.NewRequest(c.method, "/", nil)
+			}
+
+			resp, err := u.Do(NewRequest(r, opts...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			_ = resp.WriteTo(rec, ioutil.Discard)
+			_ = resp.Err()
+
+			if resp.Backend() != c.backend {
+				t.Fatalf("served by %s, expected %s", resp.Backend(), c.backend)
+			}
+
+			if c.backend == "b" && c.method == "POST" && rec.Body.String() != "hello" {
+				t.Fatalf("body = %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestUpstreamRetryConnect(t *testing.T) {
+	srv := fastcgitest.NewPipeServer(okHandler)
+	defer srv.Close()
+
+	refused := func(ctx context.Context) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+
+	u, err := NewUpstream(&UpstreamConfig{Retry: &RetryConfig{}},
+		NewBackend(NewClient(refused, PoolConfig{}, OptionName("a")), BackendConfig{}),
+		NewBackend(NewClient(srv.Dial, PoolConfig{}, OptionName("b")), BackendConfig{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer u.Close()
+
+	//unbuffered body has not been read yet
+	r := httptest.NewRequest("PUT", "/", strings.NewReader("hello"))
+	if backend := serve(t, u, r); backend != "b" {
+		t.Fatalf("served by %s", backend)
+	}
+
+	if u.backends[0].Available() {
+		t.Fatal("refusing backend is available")
+	}
+}
+
+func TestUpstreamBreaker(t *testing.T) {
+	failing := func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{Fault: fastcgitest.FaultClose}
+	}
+
+	cfg := &UpstreamConfig{
+		Breaker:  &BreakerConfig{MinRequests: 2, OpenTimeout: time.Minute},
+		Backends: []BackendConfig{{MaxFails: -1}, {MaxFails: -1}},
+	}
+
+	u := testUpstream(t, cfg, okHandler, failing)
+
+	var changes []string
+	u.OnBreaker(func(b *Backend, state BreakerState) {
+		changes = append(changes, b.Name()+" "+state.String())
+	})
+
+	//b opens after its second failure
+	if seq := sequence(t, u, 6); seq != "ababaa" {
+		t.Fatalf("sequence = %s", seq)
+	}
+
+	if state, trips := u.backends[1].Breaker(); state != BreakerOpen || trips != 1 {
+		t.Fatalf("breaker %s after %d trips", state, trips)
+	}
+
+	if len(changes) != 1 || changes[0] != "b open" {
+		t.Fatalf("changes = %v", changes)
+	}
+}
+
+func TestUpstreamBreakerLatencyExcludesClient(t *testing.T) {
+	cfg := &UpstreamConfig{
+		Breaker:  &BreakerConfig{MinRequests: 2, Latency: 50 * time.Millisecond, OpenTimeout: time.Minute},
+		Backends: []BackendConfig{{MaxFails: -1}},
+	}
+
+	u := testUpstream(t, cfg, func(req *fastcgitest.Request) *fastcgitest.Response {
+		return &fastcgitest.Response{Status: 200, Stdout: [][]byte{[]byte("fast")}}
+	})
+
+	//backend responds right away, client takes its time to read the response
+	for i := 0; i < 3; i++ {
+		resp, err := u.Do(NewRequest(httptest.NewRequest("GET", "/", nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		_ = resp.WriteTo(httptest.NewRecorder(), ioutil.Discard)
+
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if state, trips := u.backends[0].Breaker(); state != BreakerClosed || trips != 0 {
+		t.Fatalf("breaker %s after %d trips, slow client was counted as slow backend", state, trips)
+	}
+}
@@ -0,0 +1,166 @@
+package fastcgi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	//ValueMaxConns is maximum amount of concurrent connections backend accepts.
+	ValueMaxConns = "FCGI_MAX_CONNS"
+
+	//ValueMaxReqs is maximum amount of concurrent requests backend accepts.
+	ValueMaxReqs = "FCGI_MAX_REQS"
+
+	//ValueMpxsConns is "1" when backend accepts concurrent requests over one connection.
+	ValueMpxsConns = "FCGI_MPXS_CONNS"
+)
+
+var errMalformedPairs = errors.New("gofast: malformed name-value pairs")
+
+//Capabilities describes backend limits reported in reply to FCGI_GET_VALUES, limits are zero
+//when not reported.
+type Capabilities struct {
+	MaxConns  uint32
+	MaxReqs   uint32
+	MpxsConns bool
+}
+
+func newCapabilities(values map[string]string) *Capabilities {
+	return &Capabilities{
+		MaxConns:  parseLimit(values[ValueMaxConns]),
+		MaxReqs:   parseLimit(values[ValueMaxReqs]),
+		MpxsConns: values[ValueMpxsConns] == "1",
+	}
+}
+
+func parseLimit(value string) uint32 {
+	limit, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0
+	}
+
+	return uint32(limit)
+}
+
+//GetValues queries management variables of the backend over dedicated connection, variables
+//unknown to the backend are omitted from the result.
+func (c *Client) GetValues(ctx context.Context, names ...string) (map[string]string, error) {
+	nc, err := c.pool.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return queryValues(ctx, nc, names...)
+}
+
+//Capabilities queries FCGI_MAX_CONNS, FCGI_MAX_REQS and FCGI_MPXS_CONNS of the backend.
+func (c *Client) Capabilities(ctx context.Context) (*Capabilities, error) {
+	values, err := c.GetValues(ctx, ValueMaxConns, ValueMaxReqs, ValueMpxsConns)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCapabilities(values), nil
+}
+
+//queryValues queries management variables over dedicated connection and closes it afterwards.
+func queryValues(ctx context.Context, nc net.Conn, names ...string) (map[string]string, error) {
+	defer func() {
+		_ = nc.Close()
+	}()
+
+	deadline := time.Now().Add(probeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	_ = nc.SetDeadline(deadline)
+
+	return newConn(nc).getValues(names...)
+}
+
+//getValues queries management variables using FCGI_GET_VALUES record. Backends usually close
+//the connection after the reply so it should not be used for requests afterwards.
+func (c *conn) getValues(names ...string) (map[string]string, error) {
+	var body bytes.Buffer
+	b := make([]byte, 8)
+
+	for _, name := range names {
+		n := encodeSize(b, uint32(len(name)))
+		n += encodeSize(b[n:], 0)
+
+		body.Write(b[:n])
+		body.WriteString(name)
+	}
+
+	if body.Len() > maxWrite {
+		return nil, fmt.Errorf("gofast: too many management variables requested")
+	}
+
+	if err := c.writeRecord(typeGetValues, 0, body.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var rec serviceRecord
+	if err := rec.read(c.rwc); err != nil {
+		return nil, err
+	}
+
+	if rec.h.Type != typeGetValuesResult || rec.h.ID != 0 {
+		return nil, fmt.Errorf("gofast: unexpected %#v record for request %d in reply to FCGI_GET_VALUES", rec.h.Type, rec.h.ID)
+	}
+
+	return parsePairs(rec.body())
+}
+
+//parsePairs decodes name-value pairs of the record body, the last value of repeated name is kept.
+func parsePairs(b []byte) (map[string]string, error) {
+	params, err := parseParams(b)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make(map[string]string, len(params))
+	for _, param := range params {
+		pairs[param.Name] = param.Value
+	}
+
+	return pairs, nil
+}
+
+//parseParams decodes name-value pairs of the record body in order.
+func parseParams(b []byte) (Params, error) {
+	var params Params
+
+	for len(b) > 0 {
+		keyLen, n := readSize(b)
+		if n == 0 {
+			return nil, errMalformedPairs
+		}
+		b = b[n:]
+
+		valLen, n := readSize(b)
+		if n == 0 {
+			return nil, errMalformedPairs
+		}
+		b = b[n:]
+
+		if uint64(keyLen)+uint64(valLen) > uint64(len(b)) {
+			return nil, errMalformedPairs
+		}
+
+		key := readString(b, keyLen)
+		b = b[keyLen:]
+
+		params.Add(key, readString(b, valLen))
+		b = b[valLen:]
+	}
+
+	return params, nil
+}
@@ -1,9 +1,16 @@
 module fast-php
 
-go 1.13
+go 1.18
 
 require (
 	github.com/json-iterator/go v1.1.9
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.5.0
 )
+
+require (
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
+	github.com/modern-go/reflect2 v0.0.0-20180701023420-4b7aa43c6742 // indirect
+	golang.org/x/sys v0.0.0-20190422165155-953cdadca894 // indirect
+)
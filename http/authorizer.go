@@ -0,0 +1,140 @@
+package http
+
+import (
+	"fast-php/fastcgi"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+//prefix of authorizer response headers carrying variables for the protected handler
+const variablePrefix = "Variable-"
+
+//Authorizer protects http handlers using FastCGI authorizer application. Requests are allowed when the
+//application responds with 200, Variable-* headers of such response are available as request attributes
+//(names upper cased, prefix removed). Any other response is passed to the client as is. Requests are
+//never let through when the authorizer failed, the client gets 502 or 504 instead, or the status
+//Handler responds with when no backend could take the request (502, 503 or 504).
+type Authorizer struct {
+	script   *fastcgi.ScriptConfig
+	upstream *fastcgi.Upstream
+	log      *logrus.Logger
+}
+
+//NewAuthorizer creates authorizer running the front controller of the script config on the upstream.
+func NewAuthorizer(script *fastcgi.ScriptConfig, upstream *fastcgi.Upstream, log *logrus.Logger) *Authorizer {
+	if log == nil {
+		log = logrus.StandardLogger()
+	}
+
+	return &Authorizer{
+		script:   script,
+		upstream: upstream,
+		log:      log,
+	}
+}
+
+//Middleware wraps handler with the authorization check.
+func (a *Authorizer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(contextKey) == nil {
+			r = AttrInit(r)
+		}
+
+		req := fastcgi.NewRequest(r, fastcgi.OptionAuthorizer(a.script))
+		entry := requestEntry(a.log, r, req)
+
+		resp, err := a.upstream.Do(req)
+		if err != nil {
+			logFailure(entry, err)
+			w.WriteHeader(errorStatus(err))
+			_, _ = w.Write([]byte(err.Error()))
+
+			return
+		}
+
+		entry = entry.WithField("backend", resp.Backend())
+		stderr := newStderrLogger(entry)
+		defer stderr.Close()
+
+		aw := &authorizerWriter{w: w, header: make(http.Header)}
+		err = resp.WriteTo(aw, stderr)
+
+		if failure := resp.Err(); failure != nil {
+			logFailure(entry, failure)
+			err = failure
+		} else if err != nil {
+			entry.WithError(err).Error("malformed authorizer response")
+		}
+
+		//only complete response grants the access, denial passed to the client already stays as is
+		if err != nil && (aw.allowed || !aw.written) {
+			status := http.StatusBadGateway
+			if _, ok := err.(*fastcgi.TimeoutError); ok {
+				status = http.StatusGatewayTimeout
+			}
+
+			w.WriteHeader(status)
+
+			return
+		}
+
+		if !aw.allowed {
+			return
+		}
+
+		for name, values := range aw.header {
+			if strings.HasPrefix(name, variablePrefix) && len(values) != 0 {
+				_ = AttrSet(r, strings.ToUpper(strings.TrimPrefix(name, variablePrefix)), values[0])
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+//authorizerWriter captures headers of the successful authorizer response and passes any other response
+//to the client.
+type authorizerWriter struct {
+	w       http.ResponseWriter
+	header  http.Header
+	allowed bool
+	written bool
+}
+
+func (aw *authorizerWriter) Header() http.Header {
+	return aw.header
+}
+
+func (aw *authorizerWriter) WriteHeader(statusCode int) {
+	if aw.written {
+		return
+	}
+
+	aw.written = true
+	if statusCode == http.StatusOK {
+		aw.allowed = true
+		return
+	}
+
+	for k, vv := range aw.header {
+		for _, v := range vv {
+			aw.w.Header().Add(k, v)
+		}
+	}
+
+	aw.w.WriteHeader(statusCode)
+}
+
+//Write discards body of the successful response.
+func (aw *authorizerWriter) Write(b []byte) (int, error) {
+	if !aw.written {
+		aw.WriteHeader(http.StatusOK)
+	}
+
+	if aw.allowed {
+		return len(b), nil
+	}
+
+	return aw.w.Write(b)
+}
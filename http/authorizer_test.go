@@ -0,0 +1,152 @@
+package http
+
+import (
+	"context"
+	"fast-php/fastcgi"
+	"fast-php/fastcgi/fastcgitest"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//testUpstream creates upstream of single fake backend.
+func testUpstream(t *testing.T, h fastcgitest.Handler, opts ...fastcgi.OptionClient) *fastcgi.Upstream {
+	srv := fastcgitest.NewPipeServer(h)
+	t.Cleanup(srv.Close)
+
+	client := fastcgi.NewClient(srv.Dial, fastcgi.PoolConfig{}, append([]fastcgi.OptionClient{fastcgi.OptionName("a")}, opts...)...)
+
+	upstream, err := fastcgi.NewUpstream(&fastcgi.UpstreamConfig{}, fastcgi.NewBackend(client, fastcgi.BackendConfig{Address: "a"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = upstream.Close()
+	})
+
+	return upstream
+}
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+
+	return log
+}
+
+func TestAuthorizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		response *fastcgitest.Response
+		status   int
+		body     string
+		user     interface{}
+	}{
+		{
+			name:     "allow",
+			response: &fastcgitest.Response{Status: 200, Header: http.Header{"Variable-User": {"alice"}}, Stdout: [][]byte{[]byte("ignored")}},
+			status:   200,
+			body:     "protected",
+			user:     "alice",
+		},
+		{
+			name:     "deny",
+			response: &fastcgitest.Response{Status: 403, Header: http.Header{"Content-Type": {"text/plain"}}, Stdout: [][]byte{[]byte("denied")}},
+			status:   403,
+			body:     "denied",
+		},
+		{
+			name:     "allowed then failed",
+			response: &fastcgitest.Response{Status: 200, Header: http.Header{"Variable-User": {"alice"}}, Fault: fastcgitest.FaultClose},
+			status:   502,
+		},
+		{
+			name:     "no response",
+			response: &fastcgitest.Response{Fault: fastcgitest.FaultClose},
+			status:   500,
+		},
+		{
+			name:     "malformed",
+			response: &fastcgitest.Response{Stdout: [][]byte{[]byte("no header block\r\n\r\n")}},
+			status:   502,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := testUpstream(t, func(req *fastcgitest.Request) *fastcgitest.Response {
+				if req.Role != fastcgi.RoleAuthorizer {
+					t.Errorf("role %d", req.Role)
+				}
+
+				//body of the request is not sent to the authorizer
+				if len(req.Stdin) != 0 || req.Params["CONTENT_LENGTH"] != "" || req.Params["CONTENT_TYPE"] != "" {
+					t.Errorf("body %q of length %q and type %q", req.Stdin, req.Params["CONTENT_LENGTH"], req.Params["CONTENT_TYPE"])
+				}
+
+				return tc.response
+			})
+
+			var user interface{}
+			protected := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user = AttrGet(r, "USER")
+				_, _ = w.Write([]byte("protected"))
+			})
+
+			a := NewAuthorizer(&fastcgi.ScriptConfig{DocumentRoot: "/app", FrontController: "auth.php"}, upstream, testLogger())
+
+			r := httptest.NewRequest("POST", "/", strings.NewReader("name=alice"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			rec := httptest.NewRecorder()
+			a.Middleware(protected).ServeHTTP(rec, r)
+
+			if rec.Code != tc.status || tc.body != "" && rec.Body.String() != tc.body {
+				t.Fatalf("status %d, body %q", rec.Code, rec.Body.String())
+			}
+
+			if user != tc.user {
+				t.Fatalf("USER attribute %v, expected %v", user, tc.user)
+			}
+		})
+	}
+}
+
+func TestAuthorizerUnavailable(t *testing.T) {
+	//backend which never accepts the connection
+	unreachable := func(ctx context.Context) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	client := fastcgi.NewClient(unreachable, fastcgi.PoolConfig{}, fastcgi.OptionName("a"),
+		fastcgi.OptionTimeouts(fastcgi.Timeouts{Connect: 50 * time.Millisecond}))
+
+	upstream, err := fastcgi.NewUpstream(&fastcgi.UpstreamConfig{}, fastcgi.NewBackend(client, fastcgi.BackendConfig{Address: "a"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer upstream.Close()
+
+	a := NewAuthorizer(&fastcgi.ScriptConfig{DocumentRoot: "/app", FrontController: "auth.php"}, upstream, testLogger())
+	protected := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request let through")
+	})
+
+	//timeout first, backend is marked down by it
+	for _, status := range []int{http.StatusGatewayTimeout, http.StatusBadGateway} {
+		rec := httptest.NewRecorder()
+		a.Middleware(protected).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		if rec.Code != status {
+			t.Fatalf("status %d, expected %d", rec.Code, status)
+		}
+	}
+}
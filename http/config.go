@@ -0,0 +1,412 @@
+package http
+
+import (
+	"errors"
+	"fast-php/fastcgi"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//Config configures http handler.
+type Config struct {
+	//MaxRequestSize specified max size for payload body in megabytes, set 0 to unlimited.
+	MaxRequestSize int64
+
+	//TrustedSubnets declare IP subnets which are allowed to set ip using X-Real-Ip and X-Forwarded-For
+	TrustedSubnets []string
+	cidrs          []*net.IPNet
+
+	//Uploads configures uploads configuration.
+	Uploads *UploadsConfig
+
+	//Script maps requests onto the PHP scripts.
+	Script *fastcgi.ScriptConfig
+
+	//Sendfile allows application to offload file downloads, disabled when nil.
+	Sendfile *fastcgi.SendfileConfig
+
+	//MaxRedirects limits CGI local redirects served for a single request, defaults to 10.
+	MaxRedirects int
+
+	//Trace dumps FastCGI records of the requests asking for it, disabled when nil.
+	Trace *TraceConfig
+
+	//BodyBuffer reads request bodies before they are passed to the backend, so chunked requests
+	//get their CONTENT_LENGTH. Disabled when nil.
+	BodyBuffer *fastcgi.BodyBuffer
+
+	//ResponseModes maps URL path prefixes onto response modes, streaming or buffered, the longest
+	//prefix wins. Responses of other paths are passed as they are read.
+	ResponseModes map[string]string
+
+	//ResponseBuffer configures buffered responses, 64KB are kept in memory by default.
+	ResponseBuffer *fastcgi.BodyBuffer
+
+	//Health configures active health checks of the backends, see HealthChecker. Disabled when nil.
+	Health *HealthConfig
+
+	//Status configures collection of php-fpm status pages, see StatusCollector. Disabled when nil.
+	Status *StatusConfig
+}
+
+const (
+	//ModeStreaming flushes the response as soon as application writes it.
+	ModeStreaming = "streaming"
+
+	//ModeBuffered reads complete response before it is sent to the client.
+	ModeBuffered = "buffered"
+)
+
+//InitDefaults must populate Config values using given Config source. Must return error if Config is not valid.
+func (c *Config) InitDefaults() error {
+	if c.Uploads == nil {
+		c.Uploads = &UploadsConfig{}
+	}
+
+	if c.Script == nil {
+		c.Script = &fastcgi.ScriptConfig{}
+	}
+
+	if c.MaxRedirects == 0 {
+		c.MaxRedirects = 10
+	}
+
+	if c.ResponseBuffer == nil {
+		c.ResponseBuffer = &fastcgi.BodyBuffer{}
+	}
+
+	//chunked bodies are not limited by the length check of the handler
+	if c.BodyBuffer != nil && c.BodyBuffer.MaxSize == 0 {
+		c.BodyBuffer.MaxSize = c.MaxRequestSize * 1024 * 1024
+	}
+
+	if c.TrustedSubnets == nil {
+		c.TrustedSubnets = []string{
+			"10.0.0.0/8",
+			"127.0.0.0/8",
+			"172.16.0.0/12",
+			"192.168.0.0/16",
+			"::1/128",
+			"fc00::/7",
+			"fe80::/10",
+		}
+	}
+
+	if err := c.Uploads.InitDefaults(); err != nil {
+		return err
+	}
+
+	if c.Trace != nil {
+		if err := c.Trace.InitDefaults(); err != nil {
+			return err
+		}
+	}
+
+	if c.Health != nil {
+		if err := c.Health.InitDefaults(); err != nil {
+			return err
+		}
+	}
+
+	if c.Status != nil {
+		if err := c.Status.InitDefaults(); err != nil {
+			return err
+		}
+	}
+
+	return c.parseCIDRs()
+}
+
+func (c *Config) parseCIDRs() error {
+	for _, cidr := range c.TrustedSubnets {
+		_, cr, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+
+		c.cidrs = append(c.cidrs, cr)
+	}
+
+	return nil
+}
+
+//IsTrusted if api can be trusted to use X-Real-Ip, X-Forwarded-For
+func (c *Config) IsTrusted(ip string) bool {
+	if c.cidrs == nil {
+		return false
+	}
+
+	i := net.ParseIP(ip)
+	if i == nil {
+		return false
+	}
+
+	for _, cird := range c.cidrs {
+		if cird.Contains(i) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Valid validates the configuration.
+func (c *Config) Valid() error {
+	if c.Uploads == nil {
+		return errors.New("malformed uploads config")
+	}
+
+	if c.Script == nil || c.Script.DocumentRoot == "" {
+		return errors.New("missing document root")
+	}
+
+	if c.Sendfile != nil {
+		if err := c.Sendfile.Valid(); err != nil {
+			return err
+		}
+	}
+
+	if c.BodyBuffer != nil {
+		if err := c.BodyBuffer.Valid(); err != nil {
+			return err
+		}
+	}
+
+	for prefix, mode := range c.ResponseModes {
+		if !strings.HasPrefix(prefix, "/") || mode != ModeStreaming && mode != ModeBuffered {
+			return fmt.Errorf("invalid response mode %q: %q", prefix, mode)
+		}
+	}
+
+	if c.ResponseBuffer != nil {
+		if err := c.ResponseBuffer.Valid(); err != nil {
+			return err
+		}
+	}
+
+	if c.Health != nil {
+		if err := c.Health.Valid(); err != nil {
+			return err
+		}
+	}
+
+	if c.Status != nil {
+		return c.Status.Valid()
+	}
+
+	return nil
+}
+
+//ResponseMode returns response mode of the path, empty when response is passed as it is read.
+func (c *Config) ResponseMode(urlPath string) string {
+	var prefix, mode string
+	for p, m := range c.ResponseModes {
+		if strings.HasPrefix(urlPath, p) && len(p) > len(prefix) {
+			prefix, mode = p, m
+		}
+	}
+
+	return mode
+}
+
+//UploadsConfig describes file location and controls access to them.
+type UploadsConfig struct {
+	//Dir contains name of directory to control access to.
+	Dir string
+
+	//Forbid specifies list of file extensions which are forbidden for access.
+	//Example: .php, .exe, .bat, .htaccess and etc.
+	Forbid []string
+}
+
+//InitDefaults sets missing values to their default values.
+func (cfg *UploadsConfig) InitDefaults() error {
+	if cfg.Forbid == nil {
+		cfg.Forbid = []string{".php", ".exe", ".bat"}
+	}
+
+	return nil
+}
+
+//TmpDir returns temporary directory.
+func (cfg *UploadsConfig) TmpDir() string {
+	if cfg.Dir != "" {
+		return cfg.Dir
+	}
+
+	return os.TempDir()
+}
+
+//Forbids must return true if file extension is not allowed for the upload.
+func (cfg *UploadsConfig) Forbids(filename string) bool {
+	ext := strings.ToLower(path.Ext(filename))
+
+	for _, v := range cfg.Forbid {
+		if ext == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+//TraceConfig enables protocol trace of the requests carrying trace header, header is only accepted
+//from trusted subnets.
+type TraceConfig struct {
+	//File records are appended to.
+	File string
+
+	//Format of the output, text or json. Defaults to text.
+	Format string
+
+	//Header enabling the trace, defaults to X-FastCGI-Trace.
+	Header string
+
+	tracer *fastcgi.Tracer
+}
+
+//InitDefaults sets missing values to their default values and opens the output.
+func (cfg *TraceConfig) InitDefaults() error {
+	if cfg.Format == "" {
+		cfg.Format = fastcgi.TraceText
+	}
+
+	if cfg.Header == "" {
+		cfg.Header = "X-FastCGI-Trace"
+	}
+
+	if cfg.tracer != nil {
+		return nil
+	}
+
+	tracer, err := fastcgi.OpenTracer(cfg.File, cfg.Format)
+	if err != nil {
+		return err
+	}
+
+	cfg.tracer = tracer
+
+	return nil
+}
+
+//HealthConfig configures active health checks using ping page of php-fpm (ping.path and
+//ping.response of the pool).
+type HealthConfig struct {
+	//PingPath is ping.path of the pools, backends can override it, see fastcgi.BackendConfig. It may
+	//be empty when every backend sets its own.
+	PingPath string
+
+	//PingResponse is the expected body, defaults to pong.
+	PingResponse string
+
+	//Interval between the checks, defaults to 5 seconds.
+	Interval time.Duration
+
+	//Timeout of single check, defaults to 2 seconds.
+	Timeout time.Duration
+
+	//Fails marks the backend down after given amount of failed checks in a row, defaults to 1.
+	Fails int
+
+	//Passes marks the backend up after given amount of passed checks in a row, defaults to 1.
+	Passes int
+}
+
+//InitDefaults sets missing values to their default values.
+func (cfg *HealthConfig) InitDefaults() error {
+	if cfg.PingResponse == "" {
+		cfg.PingResponse = "pong"
+	}
+
+	if cfg.Interval == 0 {
+		cfg.Interval = 5 * time.Second
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+
+	if cfg.Fails == 0 {
+		cfg.Fails = 1
+	}
+
+	if cfg.Passes == 0 {
+		cfg.Passes = 1
+	}
+
+	return nil
+}
+
+//Valid validates the configuration.
+func (cfg *HealthConfig) Valid() error {
+	if cfg.PingPath != "" && !strings.HasPrefix(cfg.PingPath, "/") {
+		return fmt.Errorf("invalid ping path %q", cfg.PingPath)
+	}
+
+	if cfg.Interval <= 0 || cfg.Timeout <= 0 {
+		return errors.New("health check interval and timeout must be positive")
+	}
+
+	return nil
+}
+
+//ValidBackends checks that every backend has ping path, its own or the one of the config.
+func (cfg *HealthConfig) ValidBackends(backends []*fastcgi.Backend) error {
+	for _, b := range backends {
+		path := b.Config().PingPath
+		if path == "" {
+			path = cfg.PingPath
+		}
+
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("invalid ping path %q of backend %s", path, b.Name())
+		}
+	}
+
+	return nil
+}
+
+//StatusConfig configures collection of php-fpm status page (pm.status_path of the pool).
+type StatusConfig struct {
+	//Path is pm.status_path of the pools.
+	Path string
+
+	//Full requests state of every process of the pools as well.
+	Full bool
+
+	//Interval between the collections, defaults to 10 seconds.
+	Interval time.Duration
+
+	//Timeout of single collection, defaults to 2 seconds.
+	Timeout time.Duration
+}
+
+//InitDefaults sets missing values to their default values.
+func (cfg *StatusConfig) InitDefaults() error {
+	if cfg.Interval == 0 {
+		cfg.Interval = 10 * time.Second
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+
+	return nil
+}
+
+//Valid validates the configuration.
+func (cfg *StatusConfig) Valid() error {
+	if !strings.HasPrefix(cfg.Path, "/") {
+		return fmt.Errorf("invalid status path %q", cfg.Path)
+	}
+
+	if cfg.Interval <= 0 || cfg.Timeout <= 0 {
+		return errors.New("status interval and timeout must be positive")
+	}
+
+	return nil
+}
@@ -1,10 +1,15 @@
 package http
 
 import (
-	_ "github.com/pkg/errors"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fast-php/fastcgi"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,8 +22,36 @@ const (
 
 	//EventError thrown on any non job error provided by road runner server.
 	EventError
+
+	//EventAbort thrown when client has gone before the response was complete and request has been
+	//aborted at the backend. See ErrorEvent as payload, error is *fastcgi.AbortError.
+	EventAbort
+
+	//EventHeaderLimit thrown when response headers of the application exceed the limits. See ErrorEvent
+	//as payload, error is fastcgi.ErrHeaderLineTooLong or fastcgi.ErrHeaderTooLarge.
+	EventHeaderLimit
+
+	//EventBackendUp thrown when health checks mark the backend up. See BackendEvent as payload.
+	EventBackendUp
+
+	//EventBackendDown thrown when health checks mark the backend down. See BackendEvent as payload.
+	EventBackendDown
+
+	//EventBreaker thrown when circuit breaker of the backend changes its state. See BreakerEvent
+	//as payload.
+	EventBreaker
 )
 
+// redirectKey keeps the local redirect the request originates from in its context.
+type redirectKey struct{}
+
+// redirect describes the request which responded with local redirect.
+type redirect struct {
+	depth int
+	url   string
+	query string
+}
+
 //ErrorEvent represents singular http error event.
 type ErrorEvent struct {
 	// Request contains client request, must not be stored.
@@ -37,10 +70,19 @@ func (e *ErrorEvent) Elapsed() time.Duration {
 	return e.elapsed
 }
 
+//BreakerEvent describes new state of the backend circuit breaker.
+type BreakerEvent struct {
+	//Backend is name of the backend.
+	Backend string
+
+	//State the breaker has changed to.
+	State fastcgi.BreakerState
+}
+
 //ResponseEvent represents singular http response event.
 type ResponseEvent struct {
-	Request *Request //Request contains client request, must not be stored.
-	Response *Response //Response contains service response.
+	Request *http.Request //Request contains client request, must not be stored.
+	Response *fastcgi.ResponsePipe //Response contains backend response.
 
 	// event timings
 	start   time.Time
@@ -52,12 +94,35 @@ func (e *ResponseEvent) Elapsed() time.Duration {
 	return e.elapsed
 }
 
-//Handler serves http connections to underlying PHP application using PSR-7 protocol. Context will include request headers,
-//parsed files and query, payload will include parsed form dataTree (if any).
+//Handler serves http connections to underlying PHP application using FastCGI protocol. Request body is streamed
+//to the application as is, parsing is left to PHP.
 type Handler struct {
-	log *logrus.Logger
-	mul sync.Mutex
-	lsn func(event int, ctx interface{})
+	cfg      *Config
+	log      *logrus.Logger
+	upstream *fastcgi.Upstream
+	mul      sync.Mutex
+	lsn      func(event int, ctx interface{})
+
+	//response latency per backend, see WriteMetrics
+	latency *histogram
+}
+
+//NewHandler creates handler passing requests to the backends of the upstream.
+func NewHandler(cfg *Config, upstream *fastcgi.Upstream, log *logrus.Logger) *Handler {
+	if log == nil {
+		log = logrus.StandardLogger()
+	}
+
+	h := &Handler{
+		cfg:      cfg,
+		log:      log,
+		upstream: upstream,
+		latency:  newHistogram(),
+	}
+
+	upstream.OnBreaker(h.breakerChanged)
+
+	return h
 }
 
 //Listen attaches handler event controller.
@@ -68,7 +133,7 @@ func (h *Handler) Listen(l func(event int, ctx interface{})) {
 	h.lsn = l
 }
 
-//serve using PSR-7 requests passed to underlying application. Attempts to serve static files first if enabled.
+//serve using FastCGI requests passed to underlying application.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
@@ -79,63 +144,223 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				h.handleError(w, r, err, start)
 				return
 			} else if size > h.cfg.MaxRequestSize * 1024 * 1024 {
-				h.handleError(w, r, New("request body max size is exceeded"), start)
+				h.handleError(w, r, errors.New("request body max size is exceeded"), start)
 				return
 			}
 		}
 	}
 
-	req, err := NewRequest(r, h.cfg.Uploads)
+	opts := []fastcgi.OptionRequest{
+		fastcgi.OptionScript(h.cfg.Script),
+		fastcgi.OptionLocalRedirects(),
+		h.remoteAddr(r),
+		h.redirectParams(r),
+	}
+
+	if h.cfg.Sendfile != nil {
+		opts = append(opts, fastcgi.OptionSendfile(h.cfg.Sendfile))
+	}
+
+	if h.cfg.BodyBuffer != nil {
+		opts = append(opts, fastcgi.OptionBodyBuffer(h.cfg.BodyBuffer))
+	}
+
+	switch h.cfg.ResponseMode(r.URL.Path) {
+		case ModeStreaming:
+			opts = append(opts, fastcgi.OptionStreaming())
+
+		case ModeBuffered:
+			opts = append(opts, fastcgi.OptionBuffered(h.cfg.ResponseBuffer))
+	}
+
+	if h.traced(r) {
+		opts = append(opts, fastcgi.OptionTrace(h.cfg.Trace.tracer))
+	}
+
+	req := fastcgi.NewRequest(r, opts...)
+	entry := requestEntry(h.log, r, req)
+
+	resp, err := h.upstream.Do(req)
 	if err != nil {
+		logFailure(entry, err)
 		h.handleError(w, r, err, start)
 		return
 	}
 
-	// proxy IP resolution
-	h.resolveIP(req)
+	// application stderr is logged line by line, failures of the client are reported by the pipe
+	entry = entry.WithField("backend", resp.Backend())
+	stderr := newStderrLogger(entry)
+	defer stderr.Close()
 
-	req.Open(h.log)
-	defer req.Close(h.log)
+	// response status has been written by the pipe already
+	err = resp.WriteTo(w, stderr)
 
-	p, err := req.Payload()
-	if err != nil {
-		h.handleError(w, r, err, start)
+	failure := resp.Err()
+	if failure != nil {
+		logFailure(entry, failure)
+	}
+
+	// client has gone, outcome is known once backend ended the request or connection was dropped
+	if abortErr, ok := failure.(*fastcgi.AbortError); ok {
+		h.throw(EventAbort, &ErrorEvent{Request: r, Error: abortErr, start: start, elapsed: time.Since(start)})
 		return
 	}
 
-	rsp, err := h.rr.Exec(p)
-	if err != nil {
-		h.handleError(w, r, err, start)
+	if rd, ok := err.(*fastcgi.LocalRedirect); ok {
+		h.redirect(w, r, rd.Location, start)
+		return
+	}
+
+	if err == fastcgi.ErrHeaderLineTooLong || err == fastcgi.ErrHeaderTooLarge {
+		entry.WithError(err).Error("response headers exceed the limit")
+		h.throw(EventHeaderLimit, &ErrorEvent{Request: r, Error: err, start: start, elapsed: time.Since(start)})
 		return
 	}
 
-	resp, err := NewResponse(rsp)
 	if err != nil {
-		h.handleError(w, r, err, start)
+		h.throw(EventError, &ErrorEvent{Request: r, Error: err, start: start, elapsed: time.Since(start)})
 		return
 	}
 
-	h.handleResponse(req, resp, start)
-	err = resp.Write(w)
+	h.handleResponse(r, resp, start)
+}
+
+// traced reports whether trusted client asked for the protocol trace of the request.
+func (h *Handler) traced(r *http.Request) bool {
+	if h.cfg.Trace == nil || h.cfg.Trace.tracer == nil || r.Header.Get(h.cfg.Trace.Header) == "" {
+		return false
+	}
+
+	return h.cfg.IsTrusted(fetchIP(r.RemoteAddr))
+}
+
+// redirect serves location of the CGI local redirect as new GET request, the same way Apache does.
+func (h *Handler) redirect(w http.ResponseWriter, r *http.Request, location string, start time.Time) {
+	prev, _ := r.Context().Value(redirectKey{}).(*redirect)
+	depth := 1
+	if prev != nil {
+		depth = prev.depth + 1
+	}
+
+	if depth > h.cfg.MaxRedirects {
+		h.handleError(w, r, errors.Errorf("too many local redirects, last to %s", location), start)
+		return
+	}
+
+	u, err := url.ParseRequestURI(location)
 	if err != nil {
 		h.handleError(w, r, err, start)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), redirectKey{}, &redirect{
+		depth: depth,
+		url:   r.URL.Path,
+		query: r.URL.RawQuery,
+	})
+
+	next := r.Clone(ctx)
+	next.Method = http.MethodGet
+	next.URL.Path, next.URL.RawPath, next.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+	next.RequestURI = location
+	next.Body = http.NoBody
+	next.ContentLength = 0
+	next.Header.Del("Content-Type")
+	next.Header.Del("Content-Length")
+
+	h.ServeHTTP(w, next)
+}
+
+// redirectParams passes the request which responded with local redirect as REDIRECT_* params.
+func (h *Handler) redirectParams(r *http.Request) fastcgi.OptionRequest {
+	return func(req *fastcgi.Request) {
+		prev, ok := r.Context().Value(redirectKey{}).(*redirect)
+		if !ok {
+			return
+		}
+
+		req.SetParam("REDIRECT_STATUS", "200")
+		req.SetParam("REDIRECT_URL", prev.url)
+
+		if prev.query != "" {
+			req.SetParam("REDIRECT_QUERY_STRING", prev.query)
+		}
+	}
+}
+
+// breakerChanged logs and throws state change of the backend circuit breaker.
+func (h *Handler) breakerChanged(b *fastcgi.Backend, state fastcgi.BreakerState) {
+	entry := h.log.WithFields(logrus.Fields{"backend": b.Name(), "state": state.String()})
+	if state == fastcgi.BreakerOpen {
+		entry.Warn("FastCGI backend circuit breaker opened")
+	} else {
+		entry.Info("FastCGI backend circuit breaker changed state")
 	}
+
+	h.throw(EventBreaker, &BreakerEvent{Backend: b.Name(), State: state})
 }
 
 // handleError sends error.
 func (h *Handler) handleError(w http.ResponseWriter, r *http.Request, err error, start time.Time) {
 	h.throw(EventError, &ErrorEvent{Request: r, Error: err, start: start, elapsed: time.Since(start)})
 
-	w.WriteHeader(500)
+	w.WriteHeader(errorStatus(err))
 	_, err = w.Write([]byte(err.Error()))
 	if err != nil {
 		h.throw(EventError, &ErrorEvent{Request: r, Error: err, start: start, elapsed: time.Since(start)})
 	}
 }
 
+// errorStatus returns status of the response to the request which failed with given error.
+func errorStatus(err error) int {
+	if _, ok := err.(*fastcgi.TimeoutError); ok {
+		return http.StatusGatewayTimeout
+	}
+
+	switch err {
+		case fastcgi.ErrNoBackend:
+			return http.StatusBadGateway
+
+		case fastcgi.ErrCircuitOpen:
+			return http.StatusServiceUnavailable
+
+		case fastcgi.ErrBodyTooLarge:
+			return http.StatusRequestEntityTooLarge
+	}
+
+	return 500
+}
+
+// requestEntry returns log entry describing the request.
+func requestEntry(log *logrus.Logger, r *http.Request, req *fastcgi.Request) *logrus.Entry {
+	return log.WithFields(logrus.Fields{
+		"request_id": requestID(r),
+		"method":     r.Method,
+		"uri":        r.RequestURI,
+		"script":     req.Param("SCRIPT_FILENAME"),
+	})
+}
+
+// logFailure logs failure of the client, timeouts are reported with the phase which stalled.
+func logFailure(entry *logrus.Entry, err error) {
+	switch e := err.(type) {
+		case *fastcgi.AbortError:
+			entry.WithError(err).Debug("FastCGI request aborted")
+
+		case *fastcgi.TimeoutError:
+			entry.WithField("phase", e.Phase).Warn("FastCGI backend timed out")
+
+		default:
+			entry.WithError(err).Error("FastCGI request failed")
+	}
+}
+
 // handleResponse triggers response event.
-func (h *Handler) handleResponse(req *Request, resp *Response, start time.Time) {
-	h.throw(EventResponse, &ResponseEvent{Request: req, Response: resp, start: start, elapsed: time.Since(start)})
+func (h *Handler) handleResponse(req *http.Request, resp *fastcgi.ResponsePipe, start time.Time) {
+	elapsed := time.Since(start)
+	h.latency.observe(resp.Backend(), elapsed)
+
+	h.throw(EventResponse, &ResponseEvent{Request: req, Response: resp, start: start, elapsed: elapsed})
 }
 
 // throw invokes event handler if any.
@@ -148,10 +373,19 @@ func (h *Handler) throw(event int, ctx interface{}) {
 	}
 }
 
+// remoteAddr passes real client ip as REMOTE_ADDR when request came through trusted proxy
+func (h *Handler) remoteAddr(r *http.Request) fastcgi.OptionRequest {
+	return func(req *fastcgi.Request) {
+		if addr := h.resolveIP(r); addr != "" {
+			req.SetParam("REMOTE_ADDR", addr)
+		}
+	}
+}
+
 // get real ip passing multiple proxy
-func (h *Handler) resolveIP(r *Request) {
-	if !h.cfg.IsTrusted(r.RemoteAddr) {
-		return
+func (h *Handler) resolveIP(r *http.Request) string {
+	if !h.cfg.IsTrusted(fetchIP(r.RemoteAddr)) {
+		return ""
 	}
 
 	if r.Header.Get("X-Forwarded-For") != "" {
@@ -161,15 +395,30 @@ func (h *Handler) resolveIP(r *Request) {
 		for i := ipCount - 1; i >= 0; i-- {
 			addr := strings.TrimSpace(ips[i])
 			if net.ParseIP(addr) != nil {
-				r.RemoteAddr = addr
-				return
+				return addr
 			}
 		}
 
-		return
+		return ""
 	}
 
 	if r.Header.Get("X-Real-Ip") != "" {
-		r.RemoteAddr = fetchIP(r.Header.Get("X-Real-Ip"))
+		return fetchIP(r.Header.Get("X-Real-Ip"))
 	}
+
+	return ""
+}
+
+// requestID returns ID of the request given by the proxy or generates new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
 }
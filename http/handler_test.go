@@ -0,0 +1,188 @@
+package http
+
+import (
+	"context"
+	"fast-php/fastcgi"
+	"fast-php/fastcgi/fastcgitest"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testHandler creates handler of the fake backend, events thrown by the handler are returned by
+//the events func.
+func testHandler(t *testing.T, cfg *Config, h fastcgitest.Handler, opts ...fastcgi.OptionClient) (*Handler, func() map[int][]interface{}) {
+	if cfg.Script == nil {
+		cfg.Script = &fastcgi.ScriptConfig{DocumentRoot: "/app", FrontController: "index.php"}
+	}
+
+	if err := cfg.InitDefaults(); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewHandler(cfg, testUpstream(t, h, opts...), testLogger())
+
+	var mu sync.Mutex
+	events := make(map[int][]interface{})
+	handler.Listen(func(event int, ctx interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		events[event] = append(events[event], ctx)
+	})
+
+	return handler, func() map[int][]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return events
+	}
+}
+
+func TestHandlerAbort(t *testing.T) {
+	started := make(chan struct{})
+	h, events := testHandler(t, &Config{}, func(req *fastcgitest.Request) *fastcgitest.Response {
+		close(started)
+		return &fastcgitest.Response{Status: 200, Delay: 5 * time.Second}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	aborts := events()[EventAbort]
+	if len(aborts) != 1 {
+		t.Fatalf("events %v", events())
+	}
+
+	abortErr, ok := aborts[0].(*ErrorEvent).Error.(*fastcgi.AbortError)
+	if !ok || !abortErr.Ended || abortErr.Cause != context.Canceled {
+		t.Fatalf("abort event carries %v", aborts[0].(*ErrorEvent).Error)
+	}
+
+	if n := len(events()[EventResponse]); n != 0 {
+		t.Fatalf("aborted request reported %d responses", n)
+	}
+}
+
+func TestHandlerLocalRedirect(t *testing.T) {
+	h, _ := testHandler(t, &Config{}, func(req *fastcgitest.Request) *fastcgitest.Response {
+		if req.Params["SCRIPT_NAME"] == "/form.php" {
+			return &fastcgitest.Response{Header: http.Header{"Location": {"/done.php?x=1"}}}
+		}
+
+		p := req.Params
+		body := fmt.Sprintf("%s %s?%s from %s?%s status=%s length=%q type=%q stdin=%d", p["REQUEST_METHOD"],
+			p["SCRIPT_NAME"], p["QUERY_STRING"], p["REDIRECT_URL"], p["REDIRECT_QUERY_STRING"],
+			p["REDIRECT_STATUS"], p["CONTENT_LENGTH"], p["CONTENT_TYPE"], len(req.Stdin))
+
+		return &fastcgitest.Response{Status: 200, Stdout: [][]byte{[]byte(body)}}
+	})
+
+	r := httptest.NewRequest("POST", "/form.php?q=1", strings.NewReader("a=1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	want := `GET /done.php?x=1 from /form.php?q=1 status=200 length="0" type="" stdin=0`
+	if rec.Code != 200 || rec.Body.String() != want {
+		t.Fatalf("status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	if rec.Header().Get("Location") != "" {
+		t.Fatalf("local redirect passed to the client: %v", rec.Header())
+	}
+}
+
+func TestHandlerRedirectLoop(t *testing.T) {
+	var mu sync.Mutex
+	served := 0
+
+	h, events := testHandler(t, &Config{MaxRedirects: 3}, func(req *fastcgitest.Request) *fastcgitest.Response {
+		mu.Lock()
+		served++
+		mu.Unlock()
+
+		return &fastcgitest.Response{Header: http.Header{"Location": {"/loop.php"}}}
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/loop.php", nil))
+
+	if rec.Code != 500 || !strings.Contains(rec.Body.String(), "too many local redirects") {
+		t.Fatalf("status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	//original request and the redirects allowed
+	mu.Lock()
+	defer mu.Unlock()
+
+	if served != 4 {
+		t.Fatalf("backend served %d requests", served)
+	}
+
+	if n := len(events()[EventError]); n != 1 {
+		t.Fatalf("%d errors thrown", n)
+	}
+}
+
+func TestHandlerHeaderLimits(t *testing.T) {
+	many := make(http.Header)
+	for i := 0; i < 100; i++ {
+		many.Set(fmt.Sprintf("X-Header-%d", i), strings.Repeat("v", 50))
+	}
+
+	cases := []struct {
+		name   string
+		header http.Header
+		status int
+		err    error
+	}{
+		{"long line", http.Header{"Set-Cookie": {strings.Repeat("c", 2048)}}, 502, fastcgi.ErrHeaderLineTooLong},
+		{"too many headers", many, 502, fastcgi.ErrHeaderTooLarge},
+		{"large but valid", http.Header{"Set-Cookie": {strings.Repeat("c", 1000)}}, 200, nil},
+	}
+
+	limits := fastcgi.HeaderLimits{MaxLine: 1024, MaxSize: 4096}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, events := testHandler(t, &Config{}, func(req *fastcgitest.Request) *fastcgitest.Response {
+				return &fastcgitest.Response{Status: 200, Header: tc.header, Stdout: [][]byte{[]byte("body")}}
+			}, fastcgi.OptionHeaderLimits(limits))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+			if rec.Code != tc.status {
+				t.Fatalf("status %d", rec.Code)
+			}
+
+			limited := events()[EventHeaderLimit]
+			if tc.err == nil {
+				if len(limited) != 0 || rec.Body.String() != "body" {
+					t.Fatalf("valid headers rejected, body %q", rec.Body.String())
+				}
+
+				return
+			}
+
+			if len(limited) != 1 || limited[0].(*ErrorEvent).Error != tc.err {
+				t.Fatalf("header limit events %v, expected %v", limited, tc.err)
+			}
+
+			if rec.Body.Len() != 0 || rec.Header().Get("Set-Cookie") != "" {
+				t.Fatalf("response of the application passed to the client: %v %q", rec.Header(), rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"fast-php/fastcgi"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//BackendEvent describes backend marked up or down by the health checks.
+type BackendEvent struct {
+	//Backend is name of the backend.
+	Backend string
+
+	//Error of the last check, nil when backend is up.
+	Error error
+}
+
+//HealthChecker is service requesting php-fpm ping page of every backend of the handler upstream.
+//Backends failing the check are marked down until they pass again, transitions are thrown as
+//EventBackendUp and EventBackendDown.
+type HealthChecker struct {
+	cfg     *HealthConfig
+	handler *Handler
+
+	//consecutive results of the backends, used by the checker goroutine only
+	results map[*fastcgi.Backend]*healthResult
+
+	stop chan struct{}
+	once sync.Once
+}
+
+type healthResult struct {
+	fails  int
+	passes int
+}
+
+//NewHealthChecker creates health checker of the handler backends.
+func NewHealthChecker(cfg *HealthConfig, handler *Handler) *HealthChecker {
+	return &HealthChecker{
+		cfg:     cfg,
+		handler: handler,
+		results: make(map[*fastcgi.Backend]*healthResult),
+		stop:    make(chan struct{}),
+	}
+}
+
+//Serve checks the backends until stopped.
+func (hc *HealthChecker) Serve() error {
+	ticker := time.NewTicker(hc.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		hc.checkAll()
+
+		select {
+			case <-ticker.C:
+			case <-hc.stop:
+				return nil
+		}
+	}
+}
+
+//Stop stops the checks.
+func (hc *HealthChecker) Stop() {
+	hc.once.Do(func() {
+		close(hc.stop)
+	})
+}
+
+//checkAll checks the backends concurrently.
+func (hc *HealthChecker) checkAll() {
+	backends := hc.handler.upstream.Backends()
+	errs := make([]error, len(backends))
+
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func(i int, b *fastcgi.Backend) {
+			defer wg.Done()
+			errs[i] = hc.check(b)
+		}(i, b)
+	}
+
+	wg.Wait()
+
+	for i, b := range backends {
+		hc.update(b, errs[i])
+	}
+}
+
+//check requests the ping page, backend must respond with the configured body.
+func (hc *HealthChecker) check(b *fastcgi.Backend) error {
+	path := b.Config().PingPath
+	if path == "" {
+		path = hc.cfg.PingPath
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hc.cfg.Timeout)
+	defer cancel()
+
+	status, body, err := b.Client().Fetch(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if status != 200 {
+		return fmt.Errorf("ping responded with status %d", status)
+	}
+
+	if !bytes.Equal(bytes.TrimSpace(body), []byte(hc.cfg.PingResponse)) {
+		return fmt.Errorf("unexpected ping response %.64q", body)
+	}
+
+	return nil
+}
+
+//update counts consecutive results and marks the backend once there is enough of them.
+func (hc *HealthChecker) update(b *fastcgi.Backend, err error) {
+	result, ok := hc.results[b]
+	if !ok {
+		result = &healthResult{}
+		hc.results[b] = result
+	}
+
+	entry := hc.handler.log.WithField("backend", b.Name())
+
+	if err != nil {
+		result.fails, result.passes = result.fails+1, 0
+		if result.fails >= hc.cfg.Fails && b.SetHealthy(false) {
+			entry.WithError(err).Warn("FastCGI backend is down")
+			hc.handler.throw(EventBackendDown, &BackendEvent{Backend: b.Name(), Error: err})
+		}
+
+		return
+	}
+
+	result.fails, result.passes = 0, result.passes+1
+	if result.passes >= hc.cfg.Passes && b.SetHealthy(true) {
+		entry.Info("FastCGI backend is up")
+		hc.handler.throw(EventBackendUp, &BackendEvent{Backend: b.Name()})
+	}
+}
@@ -0,0 +1,118 @@
+package http
+
+import (
+	"fast-php/fastcgi"
+	"fast-php/fastcgi/fastcgitest"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHealthChecker(t *testing.T) {
+	var healthy int32 = 1
+	srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+		body := "pong"
+		if req.Params["SCRIPT_NAME"] != "/ping" || atomic.LoadInt32(&healthy) == 0 {
+			body = "busy"
+		}
+
+		return &fastcgitest.Response{
+			Header: http.Header{"Content-Type": {"text/plain"}},
+			Stdout: [][]byte{[]byte(body)},
+		}
+	})
+	defer srv.Close()
+
+	client := fastcgi.NewClient(srv.Dial, fastcgi.PoolConfig{}, fastcgi.OptionName("fpm"))
+	backend := fastcgi.NewBackend(client, fastcgi.BackendConfig{Address: "fpm"})
+
+	upstream, err := fastcgi.NewUpstream(&fastcgi.UpstreamConfig{}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer upstream.Close()
+
+	cfg := &HealthConfig{PingPath: "/ping", Fails: 2}
+	if err := cfg.InitDefaults(); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+
+	h := NewHandler(&Config{}, upstream, log)
+
+	var events []int
+	h.Listen(func(event int, ctx interface{}) {
+		if e, ok := ctx.(*BackendEvent); !ok || e.Backend != "fpm" {
+			t.Fatalf("event payload %#v", ctx)
+		}
+
+		events = append(events, event)
+	})
+
+	hc := NewHealthChecker(cfg, h)
+
+	hc.checkAll()
+	if !backend.Healthy() || len(events) != 0 {
+		t.Fatalf("healthy backend: healthy %v, events %v", backend.Healthy(), events)
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+
+	hc.checkAll()
+	if !backend.Healthy() {
+		t.Fatal("backend marked down after single failure")
+	}
+
+	hc.checkAll()
+	hc.checkAll()
+	if backend.Healthy() || backend.Available() {
+		t.Fatal("backend is up after failures")
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+
+	hc.checkAll()
+	if !backend.Healthy() {
+		t.Fatal("backend is down after passed check")
+	}
+
+	if len(events) != 2 || events[0] != EventBackendDown || events[1] != EventBackendUp {
+		t.Fatalf("events = %v", events)
+	}
+}
+
+func TestHealthConfigPingPath(t *testing.T) {
+	own := fastcgi.NewBackend(fastcgi.NewClient(nil, fastcgi.PoolConfig{}, fastcgi.OptionName("own")), fastcgi.BackendConfig{PingPath: "/fpm-ping"})
+	other := fastcgi.NewBackend(fastcgi.NewClient(nil, fastcgi.PoolConfig{}, fastcgi.OptionName("other")), fastcgi.BackendConfig{})
+
+	cases := []struct {
+		name     string
+		path     string
+		backends []*fastcgi.Backend
+		valid    bool
+	}{
+		{name: "backend paths", path: "", backends: []*fastcgi.Backend{own}, valid: true},
+		{name: "global path", path: "/ping", backends: []*fastcgi.Backend{own, other}, valid: true},
+		{name: "missing path", path: "", backends: []*fastcgi.Backend{own, other}},
+		{name: "relative path", path: "ping", backends: []*fastcgi.Backend{other}},
+	}
+
+	for _, c := range cases {
+		cfg := &HealthConfig{PingPath: c.path}
+		_ = cfg.InitDefaults()
+
+		err := cfg.Valid()
+		if err == nil {
+			err = cfg.ValidBackends(c.backends)
+		}
+
+		if (err == nil) != c.valid {
+			t.Fatalf("%s: error = %v", c.name, err)
+		}
+	}
+}
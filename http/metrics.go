@@ -0,0 +1,150 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//latencyBuckets are upper bounds of the latency histogram in seconds.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+//MetricsCollector writes its metrics in Prometheus text exposition format.
+type MetricsCollector interface {
+	WriteMetrics(w *MetricsWriter)
+}
+
+//MetricsHandler serves metrics of the collectors in Prometheus text exposition format.
+func MetricsHandler(collectors ...MetricsCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		mw := &MetricsWriter{w: bufio.NewWriter(w)}
+		for _, c := range collectors {
+			c.WriteMetrics(mw)
+		}
+
+		_ = mw.w.Flush()
+	})
+}
+
+//MetricsWriter writes metric families in Prometheus text exposition format.
+type MetricsWriter struct {
+	w *bufio.Writer
+}
+
+//Family starts metric family of given type, counter, gauge or histogram.
+func (mw *MetricsWriter) Family(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+//Sample writes sample of the family, labels are given as name and value pairs.
+func (mw *MetricsWriter) Sample(name string, value float64, labels ...string) {
+	mw.w.WriteString(name)
+
+	if len(labels) != 0 {
+		mw.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i != 0 {
+				mw.w.WriteByte(',')
+			}
+
+			fmt.Fprintf(mw.w, "%s=%s", labels[i], strconv.Quote(labels[i+1]))
+		}
+		mw.w.WriteByte('}')
+	}
+
+	fmt.Fprintf(mw.w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+//histogram counts observations into latencyBuckets per label value.
+type histogram struct {
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{series: make(map[string]*histogramSeries)}
+}
+
+//observe records the duration under given label value.
+func (h *histogram) observe(label string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[label]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(latencyBuckets))}
+		h.series[label] = s
+	}
+
+	v := d.Seconds()
+	for i, le := range latencyBuckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+
+	s.count++
+	s.sum += v
+}
+
+//write writes histogram samples of the family, series are labeled by given label name.
+func (h *histogram) write(mw *MetricsWriter, name, label string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := h.series[k]
+		for i, le := range latencyBuckets {
+			mw.Sample(name+"_bucket", float64(s.counts[i]), label, k, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+
+		mw.Sample(name+"_bucket", float64(s.count), label, k, "le", "+Inf")
+		mw.Sample(name+"_sum", s.sum, label, k)
+		mw.Sample(name+"_count", float64(s.count), label, k)
+	}
+}
+
+//WriteMetrics writes latency of the responses, requests in flight and circuit breakers per backend.
+func (h *Handler) WriteMetrics(mw *MetricsWriter) {
+	mw.Family("fastphp_request_duration_seconds", "histogram", "Time to serve the response by backend.")
+	h.latency.write(mw, "fastphp_request_duration_seconds", "backend")
+
+	mw.Family("fastphp_backend_in_flight", "gauge", "Requests in flight by backend.")
+	for _, b := range h.upstream.Backends() {
+		mw.Sample("fastphp_backend_in_flight", float64(b.InFlight()), "backend", b.Name())
+	}
+
+	if h.upstream.Breaker() == nil {
+		return
+	}
+
+	mw.Family("fastphp_breaker_state", "gauge", "Circuit breaker state by backend, 0 closed, 1 open, 2 half-open.")
+	for _, b := range h.upstream.Backends() {
+		state, _ := b.Breaker()
+		mw.Sample("fastphp_breaker_state", float64(state), "backend", b.Name())
+	}
+
+	mw.Family("fastphp_breaker_opened_total", "counter", "Times circuit breaker opened by backend.")
+	for _, b := range h.upstream.Backends() {
+		_, trips := b.Breaker()
+		mw.Sample("fastphp_breaker_opened_total", float64(trips), "backend", b.Name())
+	}
+}
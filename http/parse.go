@@ -60,8 +60,9 @@ func (d dataTree) mount(i []string, v []string) {
 }
 
 // parse incoming dataTree request into JSON (including contentMultipart form dataTree)
-func parseUploads(r *http.Request) *Uploads {
+func parseUploads(r *http.Request, cfg *UploadsConfig) *Uploads {
 	u := &Uploads{
+		cfg:  cfg,
 		tree: make(fileTree),
 		list: make([]*FileUpload, 0),
 	}
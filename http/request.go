@@ -128,10 +128,19 @@ func (r *Request) Close(log *logrus.Logger) {
 	r.Uploads.Clear(log)
 }
 
+// Payload carries marshaled request context and body.
+type Payload struct {
+	// Context represent payload context, might be omitted.
+	Context []byte
+
+	// Body contains binary payload to be processed by PHP.
+	Body []byte
+}
+
 // Payload request marshaled RoadRunner payload based on PSR7 data. values encode method is JSON. Make sure to open
 // files prior to calling this method.
-func (r *Request) Payload() (p *roadrunner.Payload, err error) {
-	p = &roadrunner.Payload{}
+func (r *Request) Payload() (p *Payload, err error) {
+	p = &Payload{}
 
 	j := json.ConfigCompatibleWithStandardLibrary
 	if p.Context, err = j.Marshal(r); err != nil {
@@ -23,7 +23,7 @@ type Response struct {
 }
 
 // NewResponse creates new response based on given rr payload.
-func NewResponse(p *roadrunner.Payload) (*Response, error) {
+func NewResponse(p *Payload) (*Response, error) {
 	r := &Response{body: p.Body}
 	j := json.ConfigCompatibleWithStandardLibrary
 	if err := j.Unmarshal(p.Context, r); err != nil {
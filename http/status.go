@@ -0,0 +1,215 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fast-php/fastcgi"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//BackendStatus is the last status page collected from the backend.
+type BackendStatus struct {
+	Backend  string              `json:"backend"`
+	Healthy  bool                `json:"healthy"`
+	InFlight int64               `json:"inFlight"`
+	Updated  time.Time           `json:"updated"`
+	Error    string              `json:"error,omitempty"`
+	Status   *fastcgi.PoolStatus `json:"status,omitempty"`
+}
+
+//StatusTotals sums status of the backends which responded.
+type StatusTotals struct {
+	AcceptedConns      uint64 `json:"acceptedConns"`
+	ListenQueue        int    `json:"listenQueue"`
+	IdleProcesses      int    `json:"idleProcesses"`
+	ActiveProcesses    int    `json:"activeProcesses"`
+	TotalProcesses     int    `json:"totalProcesses"`
+	MaxChildrenReached uint64 `json:"maxChildrenReached"`
+	SlowRequests       uint64 `json:"slowRequests"`
+	InFlight           int64  `json:"inFlight"`
+}
+
+//StatusReport aggregates status of all the backends.
+type StatusReport struct {
+	Backends []*BackendStatus `json:"backends"`
+	Total    StatusTotals     `json:"total"`
+}
+
+//StatusCollector is service fetching php-fpm status page of every backend of the handler upstream.
+//Collected status is served as JSON by ServeHTTP and as metrics by WriteMetrics.
+type StatusCollector struct {
+	cfg     *StatusConfig
+	handler *Handler
+
+	mu     sync.Mutex
+	status map[*fastcgi.Backend]*BackendStatus
+
+	stop chan struct{}
+	once sync.Once
+}
+
+//NewStatusCollector creates status collector of the handler backends.
+func NewStatusCollector(cfg *StatusConfig, handler *Handler) *StatusCollector {
+	return &StatusCollector{
+		cfg:     cfg,
+		handler: handler,
+		status:  make(map[*fastcgi.Backend]*BackendStatus),
+		stop:    make(chan struct{}),
+	}
+}
+
+//Serve collects the status until stopped.
+func (sc *StatusCollector) Serve() error {
+	ticker := time.NewTicker(sc.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		sc.collectAll()
+
+		select {
+			case <-ticker.C:
+			case <-sc.stop:
+				return nil
+		}
+	}
+}
+
+//Stop stops the collection.
+func (sc *StatusCollector) Stop() {
+	sc.once.Do(func() {
+		close(sc.stop)
+	})
+}
+
+//collectAll fetches status of the backends concurrently.
+func (sc *StatusCollector) collectAll() {
+	var wg sync.WaitGroup
+	for _, b := range sc.handler.upstream.Backends() {
+		wg.Add(1)
+		go func(b *fastcgi.Backend) {
+			defer wg.Done()
+			sc.collect(b)
+		}(b)
+	}
+
+	wg.Wait()
+}
+
+//collect fetches status of the backend, status of the previous collection is kept on failure.
+func (sc *StatusCollector) collect(b *fastcgi.Backend) {
+	ctx, cancel := context.WithTimeout(context.Background(), sc.cfg.Timeout)
+	defer cancel()
+
+	ps, err := b.Client().Status(ctx, sc.cfg.Path, sc.cfg.Full)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	bs, ok := sc.status[b]
+	if !ok {
+		bs = &BackendStatus{Backend: b.Name()}
+		sc.status[b] = bs
+	}
+
+	if err != nil {
+		sc.handler.log.WithField("backend", b.Name()).WithError(err).Debug("php-fpm status is unavailable")
+		bs.Error = err.Error()
+		return
+	}
+
+	bs.Error, bs.Status, bs.Updated = "", ps, time.Now()
+}
+
+//Report returns status of the backends collected last.
+func (sc *StatusCollector) Report() *StatusReport {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	report := &StatusReport{Backends: make([]*BackendStatus, 0, len(sc.status))}
+	for _, b := range sc.handler.upstream.Backends() {
+		bs := &BackendStatus{Backend: b.Name()}
+		if last, ok := sc.status[b]; ok {
+			*bs = *last
+		}
+
+		bs.Healthy, bs.InFlight = b.Healthy(), b.InFlight()
+		report.Backends = append(report.Backends, bs)
+		report.Total.InFlight += bs.InFlight
+
+		if bs.Status == nil || bs.Error != "" {
+			continue
+		}
+
+		report.Total.AcceptedConns += bs.Status.AcceptedConns
+		report.Total.ListenQueue += bs.Status.ListenQueue
+		report.Total.IdleProcesses += bs.Status.IdleProcesses
+		report.Total.ActiveProcesses += bs.Status.ActiveProcesses
+		report.Total.TotalProcesses += bs.Status.TotalProcesses
+		report.Total.MaxChildrenReached += bs.Status.MaxChildrenReached
+		report.Total.SlowRequests += bs.Status.SlowRequests
+	}
+
+	return report
+}
+
+//ServeHTTP serves the report as JSON, meant for admin endpoint.
+func (sc *StatusCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(sc.Report())
+}
+
+//WriteMetrics writes status of the pools, backends which failed the last collection are reported
+//as down.
+func (sc *StatusCollector) WriteMetrics(mw *MetricsWriter) {
+	report := sc.Report()
+
+	mw.Family("fastphp_fpm_up", "gauge", "Whether the last status collection of the backend succeeded.")
+	for _, bs := range report.Backends {
+		up := 0.0
+		if bs.Status != nil && bs.Error == "" {
+			up = 1
+		}
+
+		mw.Sample("fastphp_fpm_up", up, "backend", bs.Backend)
+	}
+
+	families := []struct {
+		name, kind, help string
+		value            func(ps *fastcgi.PoolStatus) float64
+	}{
+		{"fastphp_fpm_accepted_connections_total", "counter", "Connections accepted by the pool.",
+			func(ps *fastcgi.PoolStatus) float64 { return float64(ps.AcceptedConns) }},
+		{"fastphp_fpm_listen_queue", "gauge", "Connections waiting for idle process.",
+			func(ps *fastcgi.PoolStatus) float64 { return float64(ps.ListenQueue) }},
+		{"fastphp_fpm_max_listen_queue", "gauge", "Maximum of the listen queue since start.",
+			func(ps *fastcgi.PoolStatus) float64 { return float64(ps.MaxListenQueue) }},
+		{"fastphp_fpm_listen_queue_length", "gauge", "Size of the socket listen queue.",
+			func(ps *fastcgi.PoolStatus) float64 { return float64(ps.ListenQueueLen) }},
+		{"fastphp_fpm_idle_processes", "gauge", "Idle processes of the pool.",
+			func(ps *fastcgi.PoolStatus) float64 { return float64(ps.IdleProcesses) }},
+		{"fastphp_fpm_active_processes", "gauge", "Active processes of the pool.",
+			func(ps *fastcgi.PoolStatus) float64 { return float64(ps.ActiveProcesses) }},
+		{"fastphp_fpm_total_processes", "gauge", "Processes of the pool.",
+			func(ps *fastcgi.PoolStatus) float64 { return float64(ps.TotalProcesses) }},
+		{"fastphp_fpm_max_active_processes", "gauge", "Maximum of active processes since start.",
+			func(ps *fastcgi.PoolStatus) float64 { return float64(ps.MaxActiveProcesses) }},
+		{"fastphp_fpm_max_children_reached_total", "counter", "Times the pool reached pm.max_children.",
+			func(ps *fastcgi.PoolStatus) float64 { return float64(ps.MaxChildrenReached) }},
+		{"fastphp_fpm_slow_requests_total", "counter", "Requests exceeding request_slowlog_timeout.",
+			func(ps *fastcgi.PoolStatus) float64 { return float64(ps.SlowRequests) }},
+	}
+
+	for _, g := range families {
+		mw.Family(g.name, g.kind, g.help)
+		for _, bs := range report.Backends {
+			if bs.Status != nil && bs.Error == "" {
+				mw.Sample(g.name, g.value(bs.Status), "backend", bs.Backend, "pool", bs.Status.Pool)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package http
+
+import (
+	"encoding/json"
+	"fast-php/fastcgi"
+	"fast-php/fastcgi/fastcgitest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestStatusCollector(t *testing.T) {
+	var backends []*fastcgi.Backend
+	for _, name := range []string{"a", "b"} {
+		name := name
+		srv := fastcgitest.NewPipeServer(func(req *fastcgitest.Request) *fastcgitest.Response {
+			if name == "b" {
+				return &fastcgitest.Response{Status: 404, Header: http.Header{"Content-Type": {"text/plain"}}}
+			}
+
+			if req.Params["SCRIPT_NAME"] != "/status" || req.Params["QUERY_STRING"] != "full&json" {
+				t.Errorf("status requested as %s?%s", req.Params["SCRIPT_NAME"], req.Params["QUERY_STRING"])
+			}
+
+			body := `{"pool":"www","accepted conn":10,"listen queue":2,"idle processes":1,"active processes":3,` +
+				`"total processes":4,"processes":[{"pid":1,"state":"Idle"}]}`
+
+			return &fastcgitest.Response{
+				Header: http.Header{"Content-Type": {"application/json"}},
+				Stdout: [][]byte{[]byte(body)},
+			}
+		})
+		defer srv.Close()
+
+		client := fastcgi.NewClient(srv.Dial, fastcgi.PoolConfig{}, fastcgi.OptionName(name))
+		backends = append(backends, fastcgi.NewBackend(client, fastcgi.BackendConfig{Address: name}))
+	}
+
+	upstream, err := fastcgi.NewUpstream(&fastcgi.UpstreamConfig{}, backends...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer upstream.Close()
+
+	cfg := &StatusConfig{Path: "/status", Full: true}
+	if err := cfg.InitDefaults(); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+
+	h := NewHandler(&Config{}, upstream, log)
+	sc := NewStatusCollector(cfg, h)
+	sc.collectAll()
+
+	rec := httptest.NewRecorder()
+	sc.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+
+	var report StatusReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Backends) != 2 || report.Backends[0].Status == nil || report.Backends[1].Error == "" {
+		t.Fatalf("report %s", rec.Body.String())
+	}
+
+	if report.Total.AcceptedConns != 10 || report.Total.ActiveProcesses != 3 || report.Total.ListenQueue != 2 {
+		t.Fatalf("totals %+v", report.Total)
+	}
+
+	if p := report.Backends[0].Status.Processes; len(p) != 1 || p[0].State != "idle" {
+		t.Fatalf("processes %+v", p)
+	}
+
+	rec = httptest.NewRecorder()
+	MetricsHandler(h, sc).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		`fastphp_fpm_up{backend="a"} 1`,
+		`fastphp_fpm_up{backend="b"} 0`,
+		`fastphp_fpm_active_processes{backend="a",pool="www"} 3`,
+		`fastphp_backend_in_flight{backend="b"} 0`,
+		"# TYPE fastphp_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("metrics miss %q:\n%s", line, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package http
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+//longest line kept in memory, longer lines are logged in parts
+const maxStderrLine = 8 * 1024
+
+//phpLevels maps PHP error types onto log levels. Fatal errors are logged as errors, logrus would
+//exit otherwise.
+var phpLevels = map[string]logrus.Level{
+	"Fatal error":             logrus.ErrorLevel,
+	"Parse error":             logrus.ErrorLevel,
+	"Recoverable fatal error": logrus.ErrorLevel,
+	"Warning":                 logrus.WarnLevel,
+	"Notice":                  logrus.InfoLevel,
+	"Deprecated":              logrus.InfoLevel,
+	"Strict Standards":        logrus.InfoLevel,
+}
+
+//stderrLogger splits application stderr into lines and logs them as entries of the request.
+type stderrLogger struct {
+	entry *logrus.Entry
+	buf   []byte
+
+	//level of the last PHP error, applied to its stack trace
+	level logrus.Level
+}
+
+func newStderrLogger(entry *logrus.Entry) *stderrLogger {
+	return &stderrLogger{
+		entry: entry,
+		level: logrus.ErrorLevel,
+	}
+}
+
+func (l *stderrLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i == -1 {
+			break
+		}
+
+		l.log(string(l.buf[:i]))
+		l.buf = l.buf[i+1:]
+	}
+
+	if len(l.buf) > maxStderrLine {
+		l.log(string(l.buf))
+		l.buf = l.buf[:0]
+	}
+
+	return len(p), nil
+}
+
+//Close logs the rest of the output.
+func (l *stderrLogger) Close() error {
+	if len(l.buf) != 0 {
+		l.log(string(l.buf))
+		l.buf = nil
+	}
+
+	return nil
+}
+
+func (l *stderrLogger) log(line string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+
+	level, errType, msg := l.parse(line)
+	if errType == "" {
+		l.entry.Log(level, msg)
+		return
+	}
+
+	l.entry.WithField("php", errType).Log(level, msg)
+}
+
+//parse recognises PHP errors, e.g. "PHP Warning:  Undefined variable $a in /app/index.php on line 3".
+//Other lines prefixed by PHP are part of the last error, remaining output is logged as error.
+func (l *stderrLogger) parse(line string) (level logrus.Level, errType string, msg string) {
+	msg = strings.TrimPrefix(line, "PHP ")
+
+	if i := strings.Index(msg, ":"); i != -1 {
+		if level, ok := phpLevels[msg[:i]]; ok {
+			l.level = level
+			return level, msg[:i], strings.TrimSpace(msg[i+1:])
+		}
+	}
+
+	if msg != line {
+		return l.level, "", strings.TrimSpace(msg)
+	}
+
+	return logrus.ErrorLevel, "", line
+}
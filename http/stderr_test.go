@@ -0,0 +1,99 @@
+package http
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+//entryHook records entries logged by the stderr logger.
+type entryHook struct {
+	entries []string
+}
+
+func (h *entryHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *entryHook) Fire(e *logrus.Entry) error {
+	entry := e.Level.String() + " " + e.Message
+	if php, ok := e.Data["php"]; ok {
+		entry += " [" + php.(string) + "]"
+	}
+
+	h.entries = append(h.entries, entry)
+
+	return nil
+}
+
+func TestStderrLogger(t *testing.T) {
+	cases := []struct {
+		name    string
+		records []string
+		entries []string
+	}{
+		{
+			name:    "levels",
+			records: []string{"PHP Warning:  Undefined variable $a in /app/index.php on line 3\nPHP Notice:  Undefined index: b\nPHP Deprecated:  old\n"},
+			entries: []string{
+				"warning Undefined variable $a in /app/index.php on line 3 [Warning]",
+				"info Undefined index: b [Notice]",
+				"info old [Deprecated]",
+			},
+		},
+		{
+			name: "stack trace",
+			records: []string{
+				"PHP Fatal error:  Uncaught Exception: boom in /app/index.php:3\n",
+				"PHP Stack trace:\nPHP   #0 {main}\n",
+			},
+			entries: []string{
+				"error Uncaught Exception: boom in /app/index.php:3 [Fatal error]",
+				"error Stack trace:",
+				"error #0 {main}",
+			},
+		},
+		{
+			name:    "trace of warning",
+			records: []string{"PHP Warning:  failed\r\nPHP   #0 {main}\r\n"},
+			entries: []string{"warning failed [Warning]", "warning #0 {main}"},
+		},
+		{
+			name:    "partial records",
+			records: []string{"PHP Not", "ice:  split ", "line\nplain ", "output", "\n\n"},
+			entries: []string{"info split line [Notice]", "error plain output"},
+		},
+		{
+			name:    "unterminated line",
+			records: []string{"PHP Parse error:  syntax error"},
+			entries: []string{"error syntax error [Parse error]"},
+		},
+		{
+			name:    "long line",
+			records: []string{strings.Repeat("x", maxStderrLine+1)},
+			entries: []string{"error " + strings.Repeat("x", maxStderrLine+1)},
+		},
+	}
+
+	for _, c := range cases {
+		hook := &entryHook{}
+
+		log := testLogger()
+		log.SetLevel(logrus.TraceLevel)
+		log.SetOutput(&strings.Builder{})
+		log.AddHook(hook)
+
+		l := newStderrLogger(logrus.NewEntry(log))
+		for _, record := range c.records {
+			_, _ = l.Write([]byte(record))
+		}
+
+		_ = l.Close()
+
+		if !reflect.DeepEqual(hook.entries, c.entries) {
+			t.Errorf("%s: entries %q, want %q", c.name, hook.entries, c.entries)
+		}
+	}
+}
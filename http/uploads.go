@@ -30,6 +30,9 @@ const (
 
 //Uploads tree manages uploaded files tree and temporary files.
 type Uploads struct {
+	//associated temp directory and forbidden extensions.
+	cfg *UploadsConfig
+
 	//pre processed data tree for Uploads.
 	tree fileTree
 
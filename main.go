@@ -1,26 +1,138 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 	"strings"
+
+	"fast-php/fastcgi"
+	fasthttp "fast-php/http"
+	"fast-php/service"
+	"github.com/sirupsen/logrus"
 )
 
-type HttpHandle struct {
-}
+func main() {
+	listen := flag.String("listen", ":8881", "http address to listen on")
+	backends := flag.String("fastcgi", "tcp://127.0.0.1:9000", "comma separated FastCGI backends, tcp://host:port or unix:///path")
+	strategy := flag.String("strategy", fastcgi.StrategyRoundRobin, "load balancing strategy: round-robin, weighted, least-in-flight or hash")
+	hashHeader := flag.String("hash-header", "", "header keying the hash strategy instead of client IP")
+	root := flag.String("root", "", "document root as seen by the backend")
+	index := flag.String("index", "index.php", "front controller, empty to pass requests to directory index")
+	trace := flag.String("trace", "", "file to dump FastCGI records of every request to")
+	ping := flag.String("ping", "", "php-fpm ping.path checked on every backend, empty disables health checks")
+	status := flag.String("status", "", "php-fpm pm.status_path collected from every backend, empty disables collection")
+	admin := flag.String("admin", "", "http address serving /status and /metrics, empty disables admin endpoint")
+	tries := flag.Int("tries", 1, "backends tried per request which failed before response headers, 0 tries all of them")
+	breakerRate := flag.Float64("breaker-rate", 0, "error rate tripping circuit breaker of the backend, 0 disables breakers unless latency is set")
+	breakerLatency := flag.Duration("breaker-latency", 0, "latency counting request as slow towards tripping the circuit breaker")
+	flag.Parse()
+
+	upstreamCfg := &fastcgi.UpstreamConfig{
+		Strategy:   *strategy,
+		HashHeader: *hashHeader,
+	}
+
+	if *breakerRate > 0 || *breakerLatency > 0 {
+		upstreamCfg.Breaker = &fastcgi.BreakerConfig{ErrorRate: *breakerRate, Latency: *breakerLatency}
+	}
+
+	if *tries != 1 {
+		upstreamCfg.Retry = &fastcgi.RetryConfig{Tries: *tries}
+	}
+
+	for _, address := range strings.Split(*backends, ",") {
+		upstreamCfg.Backends = append(upstreamCfg.Backends, fastcgi.BackendConfig{Address: strings.TrimSpace(address)})
+	}
+
+	var opts []fastcgi.OptionClient
+	if *trace != "" {
+		tracer, err := fastcgi.OpenTracer(*trace, fastcgi.TraceText)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		opts = append(opts, fastcgi.OptionTraceAll(tracer))
+	}
+
+	upstream, err := fastcgi.DialUpstream(upstreamCfg, fastcgi.PoolConfig{}, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := &fasthttp.Config{
+		Script: &fastcgi.ScriptConfig{
+			DocumentRoot:    *root,
+			FrontController: *index,
+		},
+	}
+
+	if *ping != "" {
+		cfg.Health = &fasthttp.HealthConfig{PingPath: *ping}
+	}
 
-func (h HttpHandle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	for key, val := range r.Header {
-		w.Write([]byte(key + ": "))
-		w.Write([]byte(strings.Join(val, ",")))
-		w.Write([]byte("\r\n"))
+	if *status != "" {
+		cfg.Status = &fasthttp.StatusConfig{Path: *status, Full: true}
 	}
 
-	if r.Header.Get("Content-Type") {
-		
+	if err := cfg.InitDefaults(); err != nil {
+		log.Fatal(err)
 	}
+
+	if err := cfg.Valid(); err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.Health != nil {
+		if err := cfg.Health.ValidBackends(upstream.Backends()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	handler := fasthttp.NewHandler(cfg, upstream, logrus.StandardLogger())
+
+	container := service.NewContainer(logrus.StandardLogger())
+	if cfg.Health != nil {
+		container.Register("health", fasthttp.NewHealthChecker(cfg.Health, handler))
+	}
+
+	collectors := []fasthttp.MetricsCollector{handler}
+	mux := http.NewServeMux()
+	if cfg.Status != nil {
+		collector := fasthttp.NewStatusCollector(cfg.Status, handler)
+		container.Register("status", collector)
+		collectors = append(collectors, collector)
+		mux.Handle("/status", collector)
+	}
+
+	mux.Handle("/metrics", fasthttp.MetricsHandler(collectors...))
+
+	if err := container.Init(flagConfig{}); err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		if err := container.Serve(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if *admin != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*admin, mux))
+		}()
+	}
+
+	log.Fatal(http.ListenAndServe(*listen, handler))
 }
 
-func main() {
-	log.Fatal(http.ListenAndServe(":8881", &HttpHandle{}))
+//flagConfig is configuration of the services, they are configured by the flags instead.
+type flagConfig struct{}
+
+func (flagConfig) Get(name string) service.Config {
+	return nil
+}
+
+func (flagConfig) Unmarshal(out interface{}) error {
+	return nil
 }